@@ -0,0 +1,191 @@
+package main
+
+import (
+	"context"
+	"strings"
+
+	"github.com/vyPal/go-lsp"
+)
+
+// CodeActionParams mirrors lsp.CodeActionParams but keeps the "only" filter
+// the client sends, which go-lsp drops.
+type CodeActionParams struct {
+	TextDocument lsp.TextDocumentIdentifier `json:"textDocument"`
+	Range        lsp.Range                  `json:"range"`
+	Context      CodeActionContext          `json:"context"`
+}
+
+type CodeActionContext struct {
+	Diagnostics []lsp.Diagnostic     `json:"diagnostics"`
+	Only        []lsp.CodeActionKind `json:"only,omitempty"`
+}
+
+type CodeAction struct {
+	Title       string             `json:"title"`
+	Kind        lsp.CodeActionKind `json:"kind,omitempty"`
+	Diagnostics []lsp.Diagnostic   `json:"diagnostics,omitempty"`
+	IsPreferred bool               `json:"isPreferred,omitempty"`
+	Edit        *lsp.WorkspaceEdit `json:"edit,omitempty"`
+	Command     *lsp.Command       `json:"command,omitempty"`
+
+	// sources are nodes the action copies text from without editing them.
+	sources []Node
+}
+
+// CodeAction computes actions on the text the AST was parsed from and moves
+// their edits onto the current text of the document.
+func (s *Server) CodeAction(ctx context.Context, params CodeActionParams) ([]CodeAction, error) {
+	uri := params.TextDocument.URI
+	doc, parsed := s.documents[string(uri)], s.parsed[string(uri)]
+	a := s.asts[string(uri)]
+	rng := offsetRange(parsed, s.astOffset(uri, positionToOffset(doc, params.Range.Start)), s.astOffset(uri, positionToOffset(doc, params.Range.End)))
+
+	actions := []CodeAction{}
+	if a == nil {
+		return actions, nil
+	}
+
+	if wantsKind(params.Context.Only, lsp.CAKQuickFix) {
+		actions = append(actions, s.liveActions(uri, s.autoImportActions(uri, parsed, a, rng))...)
+	}
+	if wantsKind(params.Context.Only, lsp.CAKRefactorExtract) {
+		actions = append(actions, s.liveActions(uri, s.extractActions(uri, parsed, a, rng))...)
+	}
+	if wantsKind(params.Context.Only, lsp.CAKRefactorInline) {
+		actions = append(actions, s.liveActions(uri, s.inlineActions(uri, parsed, a, rng))...)
+	}
+	if wantsKind(params.Context.Only, lsp.CAKSourceOrganizeImports) {
+		if action := s.organizeImportsAction(uri, parsed, a); action != nil {
+			actions = append(actions, s.liveActions(uri, []CodeAction{*action})...)
+		}
+	}
+	actions = append(actions, s.liveActions(uri, s.classActions(uri, parsed, a, rng, params.Context.Only))...)
+
+	return actions, nil
+}
+
+// liveActions moves the edits of actions computed on the parsed text of a
+// document onto its current text. Actions touching or copying text that was
+// edited since the parse are dropped.
+func (s *Server) liveActions(uri lsp.DocumentURI, actions []CodeAction) []CodeAction {
+	live := []CodeAction{}
+	for _, action := range actions {
+		if action, ok := s.liveAction(uri, action); ok {
+			live = append(live, action)
+		}
+	}
+	return live
+}
+
+func (s *Server) liveAction(uri lsp.DocumentURI, action CodeAction) (CodeAction, bool) {
+	for _, n := range action.sources {
+		start, end := nodeOffsets(n)
+		if _, _, ok := s.liveSpan(uri, start, end); !ok {
+			return action, false
+		}
+	}
+	if action.Edit == nil {
+		return action, true
+	}
+	edits, ok := s.liveEdits(uri, action.Edit.Changes[string(uri)])
+	if !ok {
+		return action, false
+	}
+	action.Edit = singleEdit(uri, edits...)
+	return action, true
+}
+
+// liveEdits moves edits computed on the parsed text of a document onto its
+// current text. It reports false when one of them touches edited text.
+func (s *Server) liveEdits(uri lsp.DocumentURI, edits []lsp.TextEdit) ([]lsp.TextEdit, bool) {
+	doc, parsed := s.documents[string(uri)], s.parsed[string(uri)]
+	live := []lsp.TextEdit{}
+	for _, e := range edits {
+		from, to, ok := s.liveSpan(uri, positionToOffset(parsed, e.Range.Start), positionToOffset(parsed, e.Range.End))
+		if !ok {
+			return nil, false
+		}
+		live = append(live, lsp.TextEdit{Range: offsetRange(doc, from, to), NewText: e.NewText})
+	}
+	return live, true
+}
+
+// wantsKind reports whether actions of the given kind pass the client's "only"
+// filter. Kinds are hierarchical, so asking for "refactor" also matches
+// "refactor.extract".
+func wantsKind(only []lsp.CodeActionKind, kind lsp.CodeActionKind) bool {
+	if len(only) == 0 {
+		return true
+	}
+	for _, o := range only {
+		if o == kind || strings.HasPrefix(string(kind), string(o)+".") {
+			return true
+		}
+	}
+	return false
+}
+
+func singleEdit(uri lsp.DocumentURI, edits ...lsp.TextEdit) *lsp.WorkspaceEdit {
+	return &lsp.WorkspaceEdit{Changes: map[string][]lsp.TextEdit{string(uri): edits}}
+}
+
+func comparePositions(a, b lsp.Position) int {
+	if a.Line != b.Line {
+		return a.Line - b.Line
+	}
+	return a.Character - b.Character
+}
+
+// rangesOverlap treats both ranges as closed so that an empty cursor range
+// touching either end of a token still counts.
+func rangesOverlap(a, b lsp.Range) bool {
+	return comparePositions(a.Start, b.End) <= 0 && comparePositions(b.Start, a.End) <= 0
+}
+
+// forEachFactor calls fn for every Factor reachable from stmts, including
+// factors nested in call arguments, casts and GEP indices.
+func forEachFactor(stmts []*Statement, fn func(*Factor)) {
+	for _, stmt := range stmts {
+		forEachFactorInStatement(stmt, fn)
+	}
+}
+
+func forEachFactorInStatement(stmt *Statement, fn func(*Factor)) {
+	if stmt != nil {
+		inspectFactors(stmt, fn)
+	}
+}
+
+func forEachFactorInExpression(expr *Expression, fn func(*Factor)) {
+	if expr != nil {
+		inspectFactors(expr, fn)
+	}
+}
+
+func inspectFactors(n Node, fn func(*Factor)) {
+	Inspect(n, func(n Node) bool {
+		if fact, ok := n.(*Factor); ok {
+			fn(fact)
+		}
+		return true
+	})
+}
+
+// forEachStatement calls fn for every statement in stmts, descending into
+// exports, function and class bodies and control flow blocks.
+func forEachStatement(stmts []*Statement, fn func(*Statement)) {
+	for _, stmt := range stmts {
+		if stmt == nil {
+			continue
+		}
+		Inspect(stmt, func(n Node) bool {
+			switch n := n.(type) {
+			case *Statement:
+				fn(n)
+			case *Expression:
+				return false
+			}
+			return true
+		})
+	}
+}
@@ -2,15 +2,15 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
-	"net/url"
-	"os"
-	"path/filepath"
-	"regexp"
 	"runtime/debug"
 	"strconv"
 	"strings"
+	"sync"
+	"unicode/utf8"
 
+	"github.com/alecthomas/participle/v2"
 	"github.com/sourcegraph/jsonrpc2"
 	"github.com/vyPal/go-lsp"
 )
@@ -30,29 +30,72 @@ func DecodeError(stderr string, conn *jsonrpc2.Conn, uri lsp.DocumentURI, ctx co
 	message := strings.Join(split[2:], ":")
 	message = strings.TrimLeft(message, " ")
 
-	rang := lsp.Range{Start: lsp.Position{Line: line - 1, Character: column - 1}, End: lsp.Position{Line: line - 1, Character: column}}
+	// The column counts bytes; convert it through the offset it points at.
+	doc := server.documents[string(uri)]
+	start := positionToOffset(doc, lsp.Position{Line: line - 1}) + column - 1
+	if start < 0 || start > len(doc) {
+		start = len(doc)
+	}
+	end := start
+	if end < len(doc) {
+		_, size := utf8.DecodeRuneInString(doc[end:])
+		end += size
+	}
+	rang := offsetRange(doc, start, end)
 	diagnostic := lsp.Diagnostic{Range: rang, Message: message, Severity: lsp.Error, Source: "CaffeineC Parser"}
 
 	conn.Notify(ctx, "textDocument/publishDiagnostics", lsp.PublishDiagnosticsParams{URI: uri, Diagnostics: []lsp.Diagnostic{diagnostic}})
 }
 
+// tokenDiagnostic reports a parse error over the whole offending token rather
+// than the single character DecodeError can recover from the message.
+func tokenDiagnostic(text string, err *participle.UnexpectedTokenError) lsp.Diagnostic {
+	t := err.Unexpected
+	rang := offsetRange(text, t.Pos.Offset, tokenEndPos(t).Offset)
+	return lsp.Diagnostic{Range: rang, Message: err.Message(), Severity: lsp.Error, Source: "CaffeineC Parser"}
+}
+
 type Server struct {
-	documents map[string]string
-	asts      map[string]*Program
-	conn      *jsonrpc2.Conn
+	documents  map[string]string
+	asts       map[string]*Program
+	parsed     map[string]string             // source of each entry in asts
+	recent     []string                      // accepted completion labels, latest first
+	semantic   map[string]lsp.SemanticTokens // last full semantic tokens, for deltas
+	resultID   int
+	inlayHints InlayHintSettings
+	modules    map[string]*moduleInfo
+	files      []string // cached moduleFiles, nil until the next walk
+	references map[string]*referenceIndex
+	runs       map[string]*projectRun // CaffeineC processes by config
+	runsMu     sync.Mutex
+	root       string
+	conn       *jsonrpc2.Conn
+
+	lensRefresh bool // client handles workspace/codeLens/refresh
+	hintRefresh bool // client handles workspace/inlayHint/refresh
 }
 
 func (s *Server) DidChange(conn *jsonrpc2.Conn, ctx context.Context, params lsp.DocumentURI, text string) error {
 	// Update the document in the server's state.
 	s.documents[string(params)] = text
+	s.noteModule(uriToPath(params))
+	if isCfConf(params) {
+		return nil
+	}
 	var err error
 	if e := TryCatch(func() {
-		ast, err = parser.Parse("", strings.NewReader(text))
+		ast, err = parseProgram(text)
 	})(); e != nil {
 		DecodeError(e.Error(), conn, params, ctx)
 		return nil
 	}
-	if err != nil {
+	var unexpected *participle.UnexpectedTokenError
+	if errors.As(err, &unexpected) {
+		conn.Notify(ctx, "textDocument/publishDiagnostics", lsp.PublishDiagnosticsParams{
+			URI: params, Diagnostics: []lsp.Diagnostic{tokenDiagnostic(text, unexpected)},
+		})
+		return nil
+	} else if err != nil {
 		DecodeError(err.Error(), conn, params, ctx)
 		return nil
 	} else {
@@ -61,9 +104,61 @@ func (s *Server) DidChange(conn *jsonrpc2.Conn, ctx context.Context, params lsp.
 		})
 	}
 	s.asts[string(params)] = ast
+	s.parsed[string(params)] = text
 	return nil
 }
 
+// astOffset maps an offset in the current text of a document to the text its
+// last successfully parsed AST was built from. Offsets inside the region
+// edited since then map to the start of that region.
+func (s *Server) astOffset(uri lsp.DocumentURI, offset int) int {
+	return mapOffset(s.documents[string(uri)], s.parsed[string(uri)], offset)
+}
+
+// docOffset is the reverse of astOffset: it maps an offset in the parsed text
+// back to the current text of the document.
+func (s *Server) docOffset(uri lsp.DocumentURI, offset int) int {
+	return mapOffset(s.parsed[string(uri)], s.documents[string(uri)], offset)
+}
+
+// liveSpan maps [start, end) in the parsed text of a document onto its current
+// text. It reports false when the span was edited since the parse.
+func (s *Server) liveSpan(uri lsp.DocumentURI, start, end int) (int, int, bool) {
+	doc, parsed := s.documents[string(uri)], s.parsed[string(uri)]
+	if start < 0 || start > end || end > len(parsed) {
+		return 0, 0, false
+	}
+	from, to := s.docOffset(uri, start), s.docOffset(uri, end)
+	if s.astOffset(uri, from) != start || s.astOffset(uri, to) != end || doc[from:to] != parsed[start:end] {
+		return 0, 0, false
+	}
+	return from, to, true
+}
+
+// mapOffset maps an offset in from to the corresponding offset in to, where
+// both texts differ in at most one contiguous region.
+func mapOffset(from, to string, offset int) int {
+	if from == to {
+		return offset
+	}
+
+	prefix := 0
+	for prefix < len(from) && prefix < len(to) && from[prefix] == to[prefix] {
+		prefix++
+	}
+	if offset <= prefix {
+		return offset
+	}
+	suffix := 0
+	for suffix < len(from)-prefix && suffix < len(to)-prefix && from[len(from)-1-suffix] == to[len(to)-1-suffix] {
+		suffix++
+	}
+	if offset >= len(from)-suffix {
+		return offset - len(from) + len(to)
+	}
+	return prefix
+}
+
 type MdHover struct {
 	Contents interface{} `json:"contents"`
 	Range    *Range      `json:"range,omitempty"`
@@ -84,573 +179,88 @@ type MarkupContent struct {
 	Value string `json:"value"`
 }
 
-func (s *Server) Complete(ctx context.Context, params lsp.CompletionParams) (*lsp.CompletionList, error) {
+func (s *Server) Complete(ctx context.Context, params lsp.CompletionParams) (*CompletionList, error) {
+	if isCfConf(params.TextDocument.URI) {
+		return &CompletionList{IsIncomplete: false, Items: []CompletionItem{}}, nil
+	}
+
 	// Get the current state of the document.
 	doc := s.documents[string(params.TextDocument.URI)]
 
 	// Get the line and character position of the completion.
 	line := int(params.Position.Line)
-	character := int(params.Position.Character)
 	lines := strings.Split(doc, "\n")
 
 	// Check if the line index is within the bounds of the lines slice.
 	if line < 0 || line >= len(lines) {
 		fmt.Println("Line index out of bounds")
-		return &lsp.CompletionList{
+		return &CompletionList{
 			IsIncomplete: false,
-			Items:        []lsp.CompletionItem{},
+			Items:        []CompletionItem{},
 		}, nil
 	}
 
 	// Check if the character index is within the bounds of the current line string.
-	if character < 0 || character > len(lines[line]) {
+	if params.Position.Character < 0 || params.Position.Character > encodedLen(lines[line]) {
 		fmt.Println("Character index out of bounds")
-		fmt.Println("Character: " + strconv.Itoa(character) + " Line length: " + strconv.Itoa(len(lines[line])))
+		fmt.Println("Character: " + strconv.Itoa(params.Position.Character) + " Line length: " + strconv.Itoa(encodedLen(lines[line])))
 		fmt.Println("Line:", line)
-		return &lsp.CompletionList{
+		return &CompletionList{
 			IsIncomplete: false,
-			Items:        []lsp.CompletionItem{},
+			Items:        []CompletionItem{},
 		}, nil
 	}
 
-	text := lines[line][:character]
-
-	// Create a slice to store the matching symbols.
-	var matchingSymbols []lsp.CompletionItem
-
-	// Iterate over the SymbolTable.
-	for name, symbol := range SymbolTable {
-		// Check if the name of the symbol contains the text.
-		if strings.Contains(name, text) {
-			// Add the symbol to the matchingSymbols slice.
-			kind := lsp.CIKVariable // Default to variable.
-
-			switch symbol.Type {
-			case "variable":
-				kind = lsp.CIKVariable
-			case "field":
-				kind = lsp.CIKField
-			case "parameter":
-				kind = lsp.CIKValue // There's no specific kind for parameters, so we use CIKValue.
-			case "function":
-				kind = lsp.CIKFunction
-			}
+	text := lines[line][:byteColumn(lines[line], params.Position.Character)]
 
-			matchingSymbols = append(matchingSymbols, lsp.CompletionItem{
-				Label:  symbol.Name,
-				Kind:   kind,
-				Detail: symbol.Type,
-			})
-			fmt.Println("Symbol: " + symbol.Name + " Type: " + symbol.Type)
-		}
+	uri := params.TextDocument.URI
+	prog := s.asts[string(uri)]
+	offset := s.astOffset(uri, positionToOffset(doc, params.Position))
+	var sc *Scope
+	var class *ClassDefinition
+	if prog != nil {
+		sc = BuildScopes(prog)
+		class = sc.EnclosingClass(offset)
 	}
 
-	// Return a list of matching symbols.
-	return &lsp.CompletionList{
-		IsIncomplete: false,
-		Items:        matchingSymbols,
-	}, nil
-}
-
-func (s *Server) Hover(ctx context.Context, params HoverParams) (*MdHover, error) {
-	// Get the current state of the document.
-	doc := s.documents[string(params.TextDocument.URI)]
-
-	// Get the line and character position of the hover.
-	line := params.Position.Line
-	character := params.Position.Character
-
-	// Get the text being hovered over.
-	// This is a simple example and may not work correctly for all cases.
-	lines := strings.Split(doc, "\n")
-	if line < len(lines) {
-		text := lines[line]
-		if character < len(text) {
-			// Match word characters around the given position.
-			re := regexp.MustCompile(`[\w*]+`)
-			matches := re.FindAllStringIndex(text, -1)
-			for _, match := range matches {
-				if match[0] <= character && character <= match[1] {
-					hoveredText := text[match[0]:match[1]]
-					if symbol, ok := SymbolTable[hoveredText]; ok {
-						if symbol.Type == "variable" {
-							return &MdHover{
-								Contents: MarkupContent{
-									Kind: "markdown",
-									Value: fmt.Sprintf(
-										"### Variable Information\n\n"+
-											"**Name:** `%s`\n\n"+
-											"**Type:** `%s`\n\n"+
-											"### Variable Definition\n\n"+
-											"```cffc\n%s\n```\n"+
-											"---\n"+
-											"[Go to variable definition](%s)",
-										symbol.Name,
-										symbol.Data["type"],
-										symbol.Data["VDefinition"],
-										symbol.Data["VLocation"],
-									),
-								},
-							}, nil
-						} else if symbol.Type == "field" {
-							return &MdHover{
-								Contents: MarkupContent{
-									Kind: "markdown",
-									Value: fmt.Sprintf(
-										"### Field Information\n\n"+
-											"**Name:** `%s`\n\n"+
-											"**Type:** `%s`\n\n"+
-											"### Field Definition\n\n"+
-											"```cffc\n%s\n```\n"+
-											"---\n"+
-											"[Go to field definition](%s)",
-										symbol.Name,
-										symbol.Data["type"],
-										symbol.Data["VDefinition"],
-										symbol.Data["VLocation"],
-									),
-								},
-							}, nil
-						} else if symbol.Type == "parameter" {
-							return &MdHover{
-								Contents: MarkupContent{
-									Kind: "markdown",
-									Value: fmt.Sprintf(
-										"### Parameter Information\n\n"+
-											"**Name:** `%s`\n\n"+
-											"**Type:** `%s`\n\n"+
-											"### Function Definition\n\n"+
-											"```cffc\n%s\n```\n"+
-											"---\n"+
-											"[Go to function definition](%s)",
-										symbol.Name,
-										symbol.Data["type"],
-										symbol.Data["FDefinition"],
-										symbol.Data["FLocation"],
-									),
-								},
-							}, nil
-						} else if symbol.Type == "function" {
-							return &MdHover{
-								Contents: MarkupContent{
-									Kind: "markdown",
-									Value: fmt.Sprintf(
-										"### Function Information\n\n"+
-											"**Name:** `%s`\n\n"+
-											"### Function Definition\n\n"+
-											"```cffc\n%s\n```\n"+
-											"---\n"+
-											"[Go to function definition](%s)",
-										symbol.Name,
-										symbol.Data["definition"],
-										symbol.Data["location"],
-									),
-								},
-							}, nil
-						}
-					}
-				}
-			}
-		}
-	}
-
-	// Return the hover information.
-	return &MdHover{}, nil
-}
-
-func (s *Server) AnalyzeAst(ctx context.Context, req *jsonrpc2.Request, uri lsp.DocumentURI) {
-	/*
-		legend := lsp.SemanticTokensLegend{
-						TokenTypes: []string{
-							"namespace", // 0
-							"class", // 1
-							"enum", // 2
-							"interface", // 3
-							"struct", // 4
-							"typeParameter", // 5
-							"type", // 6
-							"parameter", // 7
-							"variable", // 8
-							"property", // 9
-							"enumMember", // 10
-							"decorator", // 11
-							"event", // 12
-							"function", // 13
-							"method", // 14
-							"macro", // 15
-							"label", // 16
-							"comment", // 17
-							"string", // 18
-							"keyword", // 19
-							"number", // 20
-							"regexp", // 21
-							"operator", // 22
-						},
-						TokenModifiers: []string{
-							"declaration",
-							"definition",
-							"readonly",
-							"static",
-							"deprecated",
-							"abstract",
-							"async",
-							"modification",
-							"documentation",
-							"defaultLibrary",
-						},
-					},
-	*/
-	tokens := lsp.SemanticTokens{
-		Data: []uint{},
-	}
-
-	a := s.asts[string(uri)]
-
-	if a == nil {
-		return
-	}
-
-	for _, stmt := range a.Statements {
-		if TryCatch(func() {
-			analyzeStatement(stmt, &tokens, uri)
-		})() != nil {
-			continue
-		}
-	}
-
-	tokens.Data = ConvertToRelativePositions(tokens.Data)
-
-	s.conn.Reply(ctx, req.ID, tokens)
-}
-
-func analyzeStatement(stmt *Statement, tokens *lsp.SemanticTokens, uri lsp.DocumentURI) {
-	if stmt.VariableDefinition != nil {
-		tokens.Data = append(tokens.Data, []uint{uint(stmt.VariableDefinition.Name.Pos.Line) - 1, uint(stmt.VariableDefinition.Name.Pos.Column) - 1, uint(len(stmt.VariableDefinition.Name.Value)), 8, 0b10}...)
-		if stmt.VariableDefinition.Assignment != nil {
-			analyzeExpression(stmt.VariableDefinition.Assignment, tokens)
-		}
-		SymbolTable[stmt.VariableDefinition.Name.Value] = CTSymbol{
-			Name: stmt.VariableDefinition.Name.Value,
-			Type: "variable",
-			Data: map[string]string{
-				"type":        stmt.VariableDefinition.Type.Value,
-				"VLocation":   fmt.Sprintf("%s#L%d", uri, stmt.VariableDefinition.Name.Pos.Line),
-				"VDefinition": "var " + stmt.VariableDefinition.Name.Value + ": " + stmt.VariableDefinition.Type.Value,
-			},
-		}
-	} else if stmt.Assignment != nil {
-		analyzeIdentifier(stmt.Assignment.Left, tokens)
-		if stmt.Assignment.Right != nil {
-			analyzeExpression(stmt.Assignment.Right, tokens)
-		}
-	} else if stmt.External != nil {
-		if stmt.External != nil {
-			tokens.Data = append(tokens.Data, []uint{uint(stmt.External.Name.Pos.Line) - 1, uint(stmt.External.Name.Pos.Column) - 1, uint(len(stmt.External.Name.Value)), 13, 0b10}...)
-			for _, p := range stmt.External.Parameters {
-				tokens.Data = append(tokens.Data, []uint{uint(p.Name.Pos.Line) - 1, uint(p.Name.Pos.Column) - 1, uint(len(p.Name.Value)), 7, 0b10}...)
-				SymbolTable[p.Name.Value] = CTSymbol{
-					Name: p.Name.Value,
-					Type: "parameter",
-					Data: map[string]string{
-						"type":      p.Type.Value,
-						"FName":     stmt.External.Name.Value,
-						"FLocation": fmt.Sprintf("%s#L%d", uri, stmt.External.Name.Pos.Line),
-						"FDefinition": "extern func " + stmt.External.Name.Value + "(" + strings.Join(func() []string {
-							var s []string
-							for _, p := range stmt.External.Parameters {
-								s = append(s, p.Name.Value+": "+p.Type.Value)
-							}
-							return s
-						}(), ", ") + "): " + stmt.External.ReturnType.Value,
-					},
-				}
-			}
-			SymbolTable[stmt.External.Name.Value] = CTSymbol{
-				Name: stmt.External.Name.Value,
-				Type: "function",
-				Data: map[string]string{
-					"location": fmt.Sprintf("%s#L%d", uri, stmt.External.Name.Pos.Line),
-					"definition": "extern func " + stmt.External.Name.Value + "(" + strings.Join(func() []string {
-						var s []string
-						for _, p := range stmt.External.Parameters {
-							s = append(s, p.Name.Value+": "+p.Type.Value)
-						}
-						return s
-					}(), ", ") + "): " + stmt.External.ReturnType.Value,
-				},
-			}
-		}
-	} else if stmt.FunctionDefinition != nil {
-		tokens.Data = append(tokens.Data, []uint{uint(stmt.FunctionDefinition.Name.Name.Pos.Line) - 1, uint(stmt.FunctionDefinition.Name.Name.Pos.Column) - 1, uint(len(stmt.FunctionDefinition.Name.Name.Value)), 13, 0b10}...)
-		for _, p := range stmt.FunctionDefinition.Parameters {
-			tokens.Data = append(tokens.Data, []uint{uint(p.Name.Pos.Line) - 1, uint(p.Name.Pos.Column) - 1, uint(len(p.Name.Value)), 7, 0b10}...)
-			SymbolTable[p.Name.Value] = CTSymbol{
-				Name: p.Name.Value,
-				Type: "parameter",
-				Data: map[string]string{
-					"type":      p.Type.Value,
-					"FName":     stmt.FunctionDefinition.Name.Name.Value,
-					"FLocation": fmt.Sprintf("%s#L%d", uri, stmt.FunctionDefinition.Name.Name.Pos.Line),
-					"FDefinition": "func " + stmt.FunctionDefinition.Name.Name.Value + "(" + strings.Join(func() []string {
-						var s []string
-						for _, p := range stmt.FunctionDefinition.Parameters {
-							s = append(s, p.Name.Value+": "+p.Type.Value)
-						}
-						return s
-					}(), ", ") + "): " + stmt.FunctionDefinition.ReturnType.Value,
-				},
-			}
-		}
-		SymbolTable[stmt.FunctionDefinition.Name.Name.Value] = CTSymbol{
-			Name: stmt.FunctionDefinition.Name.Name.Value,
-			Type: "function",
-			Data: map[string]string{
-				"location": fmt.Sprintf("%s#L%d", uri, stmt.FunctionDefinition.Name.Name.Pos.Line),
-				"definition": "func " + stmt.FunctionDefinition.Name.Name.Value + "(" + strings.Join(func() []string {
-					var s []string
-					for _, p := range stmt.FunctionDefinition.Parameters {
-						s = append(s, p.Name.Value+": "+p.Type.Value)
-					}
-					return s
-				}(), ", ") + "): " + stmt.FunctionDefinition.ReturnType.Value,
-			},
-		}
-		for _, s := range stmt.FunctionDefinition.Body {
-			analyzeStatement(s, tokens, uri)
-		}
-	} else if stmt.ClassDefinition != nil {
-		tokens.Data = append(tokens.Data, []uint{uint(stmt.ClassDefinition.Name.Pos.Line) - 1, uint(stmt.ClassDefinition.Name.Pos.Column) - 1, uint(len(stmt.ClassDefinition.Name.Value)), 1, 0b1}...)
-		for _, s := range stmt.ClassDefinition.Body {
-			analyzeStatement(s, tokens, uri)
-		}
-	} else if stmt.If != nil {
-		analyzeExpression(stmt.If.Condition, tokens)
-		for _, s := range stmt.If.Body {
-			analyzeStatement(s, tokens, uri)
-		}
-		for _, e := range stmt.If.ElseIf {
-			analyzeExpression(e.Condition, tokens)
-		}
-		for _, s := range stmt.If.Else {
-			analyzeStatement(s, tokens, uri)
-		}
-	} else if stmt.For != nil {
-		if stmt.For.Initializer != nil {
-			analyzeStatement(stmt.For.Initializer, tokens, uri)
-		}
-		if stmt.For.Condition != nil {
-			analyzeExpression(stmt.For.Condition, tokens)
-		}
-		if stmt.For.Increment != nil {
-			analyzeStatement(stmt.For.Increment, tokens, uri)
-		}
-		for _, s := range stmt.For.Body {
-			analyzeStatement(s, tokens, uri)
-		}
-	} else if stmt.Expression != nil {
-		analyzeExpression(stmt.Expression, tokens)
-	} else if stmt.While != nil {
-		for _, s := range stmt.While.Body {
-			analyzeStatement(s, tokens, uri)
-		}
-	} else if stmt.Import != nil {
-		uri, err := url.Parse(string(uri))
-		if err != nil {
-			fmt.Println(err)
-			return
-		}
-
-		// Get the directory of the current file.
-		dir := filepath.Dir(uri.Path)
-
-		importPath, err := ResolveImportPath(strings.Trim(stmt.Import.Package, "\""), cache)
-		if err != nil {
-			fmt.Println(err)
-			return
-		}
-
-		if !filepath.IsAbs(importPath) {
-			importPath = filepath.Join(dir, importPath)
-		}
-
-		if !strings.HasSuffix(importPath, ".cffc") {
-			importPath += ".cffc"
-		}
-
-		// Read the file contents.
-		content, err := os.ReadFile(importPath)
-		if err != nil {
-			fmt.Println(err)
-			return
-		}
-
-		fmt.Println("Adding file in SymbolTable: " + importPath)
-
-		// Parse the file.
-		var importedAst *Program
-		if e := TryCatch(func() {
-			importedAst, err = parser.Parse("", strings.NewReader(string(content)))
-		})(); e != nil {
-			return
-		}
-		if err != nil {
-			return
-		}
-
-		// Loop through all the statements in the AST.
-		for _, importedStmt := range importedAst.Statements {
-			// If the statement is an export statement, add it to the SymbolTable.
-			if importedStmt.Export != nil {
-				var symbol CTSymbol
-				// Check if the export statement has a function.
-				if importedStmt.Export.FunctionDefinition != nil {
-					symbol = CTSymbol{
-						Name: importedStmt.Export.FunctionDefinition.Name.Name.Value,
-						Type: "function",
-						Data: map[string]string{
-							"location": fmt.Sprintf("%s#L%d", importPath, importedStmt.Export.FunctionDefinition.Name.Name.Pos.Line),
-							"definition": "func " + importedStmt.Export.FunctionDefinition.Name.Name.Value + "(" + strings.Join(func() []string {
-								var s []string
-								for _, p := range importedStmt.Export.FunctionDefinition.Parameters {
-									s = append(s, p.Name.Value+": "+p.Type.Value)
-								}
-								return s
-							}(), ", ") + "): " + importedStmt.Export.FunctionDefinition.ReturnType.Value,
-						},
-					}
-				} else if importedStmt.Export.External != nil {
-					symbol = CTSymbol{
-						Name: importedStmt.Export.External.Name.Value,
-						Type: "function",
-						Data: map[string]string{
-							"location": fmt.Sprintf("%s#L%d", importPath, importedStmt.Export.External.Name.Pos.Line),
-							"definition": "extern func " + importedStmt.Export.External.Name.Value + "(" + strings.Join(func() []string {
-								var s []string
-								for _, p := range importedStmt.Export.External.Parameters {
-									s = append(s, p.Name.Value+": "+p.Type.Value)
-								}
-								return s
-							}(), ", ") + "): " + importedStmt.Export.External.ReturnType.Value,
-						},
-					}
-				}
-				SymbolTable[symbol.Name] = symbol
+	var items []CompletionItem
+	if chain, ok := receiverChain(text); ok {
+		// After a `.` only the members of the receiver make sense.
+		items = s.memberCompletions(uri, doc, prog, params.Position, chain)
+	} else {
+		// Offer the keywords and snippets that fit where the cursor is.
+		// Symbols only make sense where a statement or expression can start.
+		where, arg := completionContextAt(text, sc, offset)
+		switch where {
+		case contextImportSymbol:
+			items = s.importSymbolCompletions(uri, arg, text)
+		case contextImportPath:
+			items = s.importPathCompletions(uri, params.Position, arg)
+		case contextType, contextNew:
+			items = s.typeCompletions(uri, doc, prog, params.Position, text, where)
+		case contextNone, contextClassBody:
+			items = keywordCompletions(where, class)
+		default:
+			items = withTier(keywordCompletions(where, class), tierKeyword)
+			if sc != nil {
+				items = append(items, symbolCompletions(uri, sc, offset)...)
+				items = append(items, s.importedCompletions(uri, prog)...)
 			}
-		}
-	} else if stmt.Return != nil {
-		analyzeExpression(stmt.Return.Expression, tokens)
-	} else if stmt.Break != nil {
-		tokens.Data = append(tokens.Data, []uint{uint(stmt.Pos.Line) - 1, uint(stmt.Pos.Column) - 1, 5, 19, 0}...)
-	} else if stmt.Continue != nil {
-		tokens.Data = append(tokens.Data, []uint{uint(stmt.Pos.Line) - 1, uint(stmt.Pos.Column) - 1, 8, 19, 0}...)
-	} else if stmt.FieldDefinition != nil {
-		SymbolTable[stmt.FieldDefinition.Name.Value] = CTSymbol{
-			Name: stmt.FieldDefinition.Name.Value,
-			Type: "field",
-			Data: map[string]string{
-				"type":        stmt.FieldDefinition.Type.Value,
-				"VLocation":   fmt.Sprintf("%s#L%d", uri, stmt.FieldDefinition.Name.Pos.Line),
-				"VDefinition": stmt.FieldDefinition.Name.Value + ": " + stmt.FieldDefinition.Type.Value,
-			},
-		}
-		tokens.Data = append(tokens.Data, []uint{uint(stmt.FieldDefinition.Name.Pos.Line) - 1, uint(stmt.FieldDefinition.Name.Pos.Column) - 1, uint(len(stmt.FieldDefinition.Name.Value)), 8, 0b10}...)
-		tokens.Data = append(tokens.Data, []uint{uint(stmt.FieldDefinition.Type.Pos.Line) - 1, uint(stmt.FieldDefinition.Type.Pos.Column) - 1, uint(len(stmt.FieldDefinition.Type.Value)), 5, 0}...)
-	} else if stmt.Export != nil {
-		analyzeStatement(stmt.Export, tokens, uri)
-	}
-}
 
-func analyzeExpression(expr *Expression, tokens *lsp.SemanticTokens) {
-	analyzeComparison(expr.Left, tokens)
-	for _, op := range expr.Right {
-		tokens.Data = append(tokens.Data, []uint{uint(op.Op.Pos.Line) - 1, uint(op.Op.Pos.Column) - 1, uint(len(op.Op.Value)), 22, 0}...)
-		analyzeComparison(op.Expression, tokens)
-	}
-}
-
-func analyzeComparison(comp *Comparison, tokens *lsp.SemanticTokens) {
-	analyzeTerm(comp.Left, tokens)
-	for _, op := range comp.Right {
-		tokens.Data = append(tokens.Data, []uint{uint(op.Op.Pos.Line) - 1, uint(op.Op.Pos.Column) - 1, uint(len(op.Op.Value)), 22, 0}...)
-		analyzeTerm(op.Comparison, tokens)
-	}
-}
-
-func analyzeTerm(term *Term, tokens *lsp.SemanticTokens) {
-	analyzeFactor(term.Left, tokens)
-	for _, op := range term.Right {
-		tokens.Data = append(tokens.Data, []uint{uint(op.Op.Pos.Line) - 1, uint(op.Op.Pos.Column) - 1, uint(len(op.Op.Value)), 22, 0}...)
-		analyzeFactor(op.Term, tokens)
-	}
-}
-
-func analyzeFactor(fact *Factor, tokens *lsp.SemanticTokens) {
-	if fact.Value != nil {
-		val := fact.Value
-		if val.Duration != nil {
-			tokens.Data = append(tokens.Data, []uint{uint(val.Duration.Pos.Line) - 1, uint(val.Duration.Pos.Column) - 1, uint(len(fmt.Sprint(val.Duration.Number))), 20, 0}...)
-			tokens.Data = append(tokens.Data, []uint{uint(val.Duration.Pos.Line - 1 + len(fmt.Sprint(val.Duration.Number))), uint(val.Duration.Pos.Column) - 1, uint(len(fmt.Sprint(val.Duration.Unit))), 6, 0}...)
-		} else if val.Float != nil {
-			tokens.Data = append(tokens.Data, []uint{uint(val.Pos.Line) - 1, uint(val.Pos.Column) - 1, uint(len(fmt.Sprint(val.Float))), 20, 0}...)
-		} else if val.Int != nil {
-			tokens.Data = append(tokens.Data, []uint{uint(val.Pos.Line) - 1, uint(val.Pos.Column) - 1, uint(len(fmt.Sprint(val.Int))), 20, 0}...)
-		} else if val.String != nil {
-			tokens.Data = append(tokens.Data, []uint{uint(val.Pos.Line) - 1, uint(val.Pos.Column) - 1, uint(len(*val.String)), 18, 0}...)
-		}
-	} else if fact.Identifier != nil {
-		analyzeIdentifier(fact.Identifier, tokens)
-	} else if fact.ClassInitializer != nil {
-		tokens.Data = append(tokens.Data, []uint{uint(fact.ClassInitializer.ClassName.Pos.Line) - 1, uint(fact.ClassInitializer.ClassName.Pos.Column) - 1, uint(len(fact.ClassInitializer.ClassName.Value)), 1, 0}...)
-		for _, e := range fact.ClassInitializer.Args.Arguments {
-			analyzeExpression(e, tokens)
-		}
-	} else if fact.FunctionCall != nil {
-		tokens.Data = append(tokens.Data, []uint{uint(fact.FunctionCall.Pos.Line) - 1, uint(fact.FunctionCall.Pos.Column) - 1, uint(len(fact.FunctionCall.FunctionName)), 13, 0}...)
-		for _, e := range fact.FunctionCall.Args.Arguments {
-			analyzeExpression(e, tokens)
-		}
-	} else if fact.ClassMethod != nil {
-		analyzeIdentifier(fact.ClassMethod.Identifier, tokens)
-		for _, e := range fact.ClassMethod.Args.Arguments {
-			analyzeExpression(e, tokens)
+			// Offer exports of other modules together with the import they need.
+			word := text[len(strings.TrimRightFunc(text, isIdentRune)):]
+			items = append(items, withTier(s.autoImportCompletions(uri, prog, word), tierAutoImport)...)
 		}
 	}
-}
 
-func analyzeIdentifier(iden *Identifier, tokens *lsp.SemanticTokens) {
-	tokens.Data = append(tokens.Data, []uint{uint(iden.Pos.Line) - 1, uint(iden.Pos.Column) - 1, uint(len(iden.Name)), 8, 0}...)
-	if iden.Sub != nil {
-		analyzeIdentifier(iden.Sub, tokens)
-	}
+	return &CompletionList{
+		IsIncomplete: false,
+		Items:        s.rankCompletions(items, text, params.Position),
+	}, nil
 }
 
-func ConvertToRelativePositions(tokensData []uint) []uint {
-	if len(tokensData) < 5 {
-		return tokensData
-	}
-
-	relativeTokensData := make([]uint, len(tokensData))
-
-	// Copy the first token as it is
-	copy(relativeTokensData[:5], tokensData[:5])
-
-	for i := 5; i < len(tokensData); i += 5 {
-		// Line number is relative to the previous token's line number
-		relativeTokensData[i] = tokensData[i] - tokensData[i-5]
-
-		// If it's the same line, make character position relative to the previous token's character position
-		// If it's a new line, character position remains the same
-		if relativeTokensData[i] == 0 {
-			relativeTokensData[i+1] = tokensData[i+1] - tokensData[i-4]
-		} else {
-			relativeTokensData[i+1] = tokensData[i+1]
-		}
-
-		// Copy the length, token type, and token modifiers as they are
-		copy(relativeTokensData[i+2:i+5], tokensData[i+2:i+5])
-	}
-
-	return relativeTokensData
+func (s *Server) Hover(ctx context.Context, params HoverParams) (*MdHover, error) {
+	return s.hoverAt(params.TextDocument.URI, params.Position), nil
 }
 
 func TryCatch(f func()) func() error {
@@ -0,0 +1,316 @@
+package main
+
+import (
+	"context"
+	"path/filepath"
+	"strings"
+
+	"github.com/vyPal/go-lsp"
+)
+
+type CallHierarchyItem struct {
+	Name           string          `json:"name"`
+	Kind           lsp.SymbolKind  `json:"kind"`
+	Detail         string          `json:"detail,omitempty"`
+	URI            lsp.DocumentURI `json:"uri"`
+	Range          lsp.Range       `json:"range"`
+	SelectionRange lsp.Range       `json:"selectionRange"`
+	Data           callItemData    `json:"data"`
+}
+
+// callItemData identifies the declaration behind a call hierarchy item. The
+// offset is that of the declaring statement, or -1 for the top level of a
+// file.
+type callItemData struct {
+	File   string `json:"file"`
+	Offset int    `json:"offset"`
+}
+
+type CallHierarchyIncomingCallsParams struct {
+	Item CallHierarchyItem `json:"item"`
+}
+
+type CallHierarchyIncomingCall struct {
+	From       CallHierarchyItem `json:"from"`
+	FromRanges []lsp.Range       `json:"fromRanges"`
+}
+
+type CallHierarchyOutgoingCallsParams struct {
+	Item CallHierarchyItem `json:"item"`
+}
+
+type CallHierarchyOutgoingCall struct {
+	To         CallHierarchyItem `json:"to"`
+	FromRanges []lsp.Range       `json:"fromRanges"`
+}
+
+// callSite is a call found in a module: the binding it calls, the function
+// it is made from, which is nil at the top level, and the offsets of the
+// called name.
+type callSite struct {
+	target, caller *Binding
+	start, end     int
+}
+
+// callSites lists every function call, method call and class instantiation
+// in the module at file whose target can be resolved.
+func (s *Server) callSites(file string) []callSite {
+	prog, err := s.loadModule(file)
+	if err != nil {
+		return nil
+	}
+	sc, err := s.scopesOf(file)
+	if err != nil {
+		return nil
+	}
+
+	var sites []callSite
+	forEachFactor(prog.Statements, func(fact *Factor) {
+		if target, start, end := s.callTarget(file, prog, sc, fact); target != nil {
+			sites = append(sites, callSite{target, enclosingFunctionBinding(sc, fact.Pos.Offset), start, end})
+		}
+	})
+	return sites
+}
+
+// callTarget resolves what fact calls and where the called name is written.
+// Instantiating a class calls its constructor, or the class itself when it
+// has none.
+func (s *Server) callTarget(file string, prog *Program, sc *Scope, fact *Factor) (*Binding, int, int) {
+	var b *Binding
+	switch {
+	case fact.FunctionCall != nil:
+		call := fact.FunctionCall
+		t, ok := nameToken(fact.Tokens, call.FunctionName)
+		if !ok {
+			return nil, 0, 0
+		}
+		if b = sc.Lookup(strings.Trim(call.FunctionName, "\""), fact.Pos.Offset); b == nil {
+			b = s.importedBinding(file, prog, strings.Trim(call.FunctionName, "\""))
+		}
+		if b == nil || (b.Kind != "function" && b.Kind != "method" && b.Kind != "extern") {
+			return nil, 0, 0
+		}
+		return b, t.Pos.Offset, tokenEnd(t)
+	case fact.ClassMethod != nil:
+		var chain []string
+		last := fact.ClassMethod.Identifier
+		for iden := last; iden != nil; iden = iden.Sub {
+			chain, last = append(chain, iden.Name), iden
+		}
+		t, ok := nameToken(last.Tokens, last.Name)
+		if !ok {
+			return nil, 0, 0
+		}
+		if class, _ := s.receiverClass(file, prog, sc, fact.Pos.Offset, chain[:len(chain)-1]); class != nil {
+			b = class.Member(last.Name)
+		}
+		if b == nil || b.Kind != "method" {
+			return nil, 0, 0
+		}
+		return b, t.Pos.Offset, tokenEnd(t)
+	case fact.ClassInitializer != nil:
+		name := &fact.ClassInitializer.ClassName
+		class := s.classScope(file, prog, sc, name.Value)
+		if class == nil {
+			return nil, 0, 0
+		}
+		if b = class.Member("constructor"); b == nil {
+			for _, c := range class.Parent.Bindings {
+				if c.Node == class.Class {
+					b = c
+				}
+			}
+		}
+		if b == nil {
+			return nil, 0, 0
+		}
+		return b, name.Pos.Offset, name.EndPos.Offset
+	}
+	return nil, 0, 0
+}
+
+// importedBinding resolves a name brought into the module at file by one of
+// its imports.
+func (s *Server) importedBinding(file string, prog *Program, name string) *Binding {
+	for _, sym := range s.importedSymbols(file, prog) {
+		if sym.Name != name {
+			continue
+		}
+		if imported, err := s.scopesOf(sym.Data["file"]); err == nil {
+			if b := imported.Lookup(sym.Data["symbol"], 0); b != nil {
+				return b
+			}
+		}
+	}
+	return nil
+}
+
+// enclosingFunctionBinding returns the binding of the function or method
+// whose body contains offset.
+func enclosingFunctionBinding(sc *Scope, offset int) *Binding {
+	for s := sc.Innermost(offset); s != nil && s.Function != nil; s = s.Parent {
+		if s.Parent == nil || s.Parent.Function == s.Function {
+			continue
+		}
+		for _, b := range s.Parent.Bindings {
+			if b.Node == s.Function {
+				return b
+			}
+		}
+	}
+	return nil
+}
+
+// fileRange converts offsets into the AST of the module at file to a range in
+// its current text.
+func (s *Server) fileRange(file string, start, end int) lsp.Range {
+	uri := pathToURI(file)
+	if doc, ok := s.documents[string(uri)]; ok {
+		return offsetRange(doc, s.docOffset(uri, start), s.docOffset(uri, end))
+	}
+	return offsetRange(s.sourceOf(file), start, end)
+}
+
+// callItem describes the callable b declared in the module at file. A nil
+// binding stands for the top level of the file.
+func (s *Server) callItem(b *Binding, file string) CallHierarchyItem {
+	if b == nil {
+		rng := s.fileRange(file, 0, len(s.sourceOf(file)))
+		return CallHierarchyItem{
+			Name:           filepath.Base(file),
+			Kind:           lsp.SKFile,
+			URI:            pathToURI(file),
+			Range:          rng,
+			SelectionRange: lsp.Range{Start: rng.Start, End: rng.Start},
+			Data:           callItemData{File: file, Offset: -1},
+		}
+	}
+
+	item := CallHierarchyItem{Name: b.Name, URI: pathToURI(file), Data: callItemData{File: file, Offset: b.Pos.Offset}}
+	switch {
+	case b.Kind == "class":
+		item.Kind, item.Detail = lsp.SKClass, "class "+b.Name
+	case b.Kind == "method" && b.Name == "constructor":
+		item.Kind, item.Detail = lsp.SKConstructor, methodSignature(b)
+	case b.Kind == "method":
+		item.Kind, item.Detail = lsp.SKMethod, methodSignature(b)
+	default:
+		item.Kind, item.Detail = lsp.SKFunction, bindingSignature(b)
+	}
+	if b.Kind == "method" {
+		// Name methods after their class so they can be told apart.
+		if class := b.Scope.Class; class != nil {
+			item.Name = class.Name.Value + "." + b.Name
+		}
+	}
+
+	start, end := b.Pos.Offset, b.Pos.Offset
+	if n, ok := b.Node.(Node); ok {
+		start, end = nodeOffsets(n)
+	}
+	item.Range = s.fileRange(file, start, end)
+	item.SelectionRange = lsp.Range{Start: item.Range.Start, End: item.Range.Start}
+	if name := declarationName(b); name != nil {
+		item.SelectionRange = s.fileRange(file, name.Pos.Offset, name.EndPos.Offset)
+	}
+	return item
+}
+
+// callFiles lists the modules searched for calls: the workspace, cached
+// packages and open documents outside of both.
+func (s *Server) callFiles() []string {
+	files := append([]string{}, s.moduleFiles()...)
+	seen := make(map[string]bool)
+	for _, file := range files {
+		seen[filepath.Clean(file)] = true
+	}
+	for uri := range s.asts {
+		if file := uriToPath(lsp.DocumentURI(uri)); !seen[filepath.Clean(file)] {
+			files = append(files, file)
+		}
+	}
+	return files
+}
+
+// sameDeclaration reports whether b, found in the module at file, is the
+// declaration data identifies.
+func sameDeclaration(b *Binding, file string, data callItemData) bool {
+	if b == nil {
+		return data.Offset < 0 && filepath.Clean(file) == filepath.Clean(data.File)
+	}
+	return b.Pos.Offset == data.Offset && filepath.Clean(bindingFile(b, file)) == filepath.Clean(data.File)
+}
+
+// PrepareCallHierarchy returns the callable at the cursor: the target of a
+// call or the function, method or class being declared.
+func (s *Server) PrepareCallHierarchy(ctx context.Context, params lsp.TextDocumentPositionParams) ([]CallHierarchyItem, error) {
+	uri := params.TextDocument.URI
+	prog := s.asts[string(uri)]
+	if prog == nil {
+		return nil, nil
+	}
+	file := uriToPath(uri)
+	offset := s.astOffset(uri, positionToOffset(s.documents[string(uri)], params.Position))
+
+	for _, site := range s.callSites(file) {
+		if site.start <= offset && offset <= site.end {
+			return []CallHierarchyItem{s.callItem(site.target, bindingFile(site.target, file))}, nil
+		}
+	}
+
+	sc, err := s.scopesOf(file)
+	if err != nil {
+		return nil, nil
+	}
+	b, _ := bindingAt(prog, sc, offset)
+	if b == nil || (b.Kind != "function" && b.Kind != "method" && b.Kind != "extern" && b.Kind != "class") {
+		return nil, nil
+	}
+	return []CallHierarchyItem{s.callItem(b, bindingFile(b, file))}, nil
+}
+
+// IncomingCalls finds the calls of an item in every module, grouped by the
+// function making them.
+func (s *Server) IncomingCalls(ctx context.Context, params CallHierarchyIncomingCallsParams) ([]CallHierarchyIncomingCall, error) {
+	calls := []CallHierarchyIncomingCall{}
+	for _, file := range s.callFiles() {
+		index := make(map[*Binding]int)
+		for _, site := range s.callSites(file) {
+			if !sameDeclaration(site.target, file, params.Item.Data) {
+				continue
+			}
+			i, ok := index[site.caller]
+			if !ok {
+				i = len(calls)
+				index[site.caller] = i
+				calls = append(calls, CallHierarchyIncomingCall{From: s.callItem(site.caller, file), FromRanges: []lsp.Range{}})
+			}
+			calls[i].FromRanges = append(calls[i].FromRanges, s.fileRange(file, site.start, site.end))
+		}
+	}
+	return calls, nil
+}
+
+// OutgoingCalls lists what an item calls, grouped by callee. Extern
+// functions have no body and so make no calls.
+func (s *Server) OutgoingCalls(ctx context.Context, params CallHierarchyOutgoingCallsParams) ([]CallHierarchyOutgoingCall, error) {
+	calls := []CallHierarchyOutgoingCall{}
+	file := params.Item.Data.File
+	index := make(map[callItemData]int)
+	for _, site := range s.callSites(file) {
+		if !sameDeclaration(site.caller, file, params.Item.Data) {
+			continue
+		}
+		target := bindingFile(site.target, file)
+		key := callItemData{File: filepath.Clean(target), Offset: site.target.Pos.Offset}
+		i, ok := index[key]
+		if !ok {
+			i = len(calls)
+			index[key] = i
+			calls = append(calls, CallHierarchyOutgoingCall{To: s.callItem(site.target, target), FromRanges: []lsp.Range{}})
+		}
+		calls[i].FromRanges = append(calls[i].FromRanges, s.fileRange(file, site.start, site.end))
+	}
+	return calls, nil
+}
@@ -0,0 +1,266 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/vyPal/go-lsp"
+)
+
+const (
+	CAKSourceGenerateConstructor lsp.CodeActionKind = "source.generate.constructor"
+	CAKSourceGenerateAccessors   lsp.CodeActionKind = "source.generate.accessors"
+	CAKSourceGenerateOperators   lsp.CodeActionKind = "source.generate.operators"
+)
+
+// operatorGroups are the overloadable operators, grouped the way their stubs
+// are offered. Comparisons return bool, arithmetic returns the class.
+var operatorGroups = []struct {
+	name string
+	ops  []string
+}{
+	{"arithmetic", []string{"+", "-", "*", "/", "%"}},
+	{"comparison", []string{"==", "!=", "<", "<=", ">", ">="}},
+}
+
+// selectedOperator returns the overloadable operator selected by [start, end),
+// or written around the cursor when the selection is empty.
+func selectedOperator(doc string, start, end int) string {
+	if start == end {
+		for start > 0 && strings.IndexByte("+-*/%=!<>&|", doc[start-1]) >= 0 {
+			start--
+		}
+		for end < len(doc) && strings.IndexByte("+-*/%=!<>&|", doc[end]) >= 0 {
+			end++
+		}
+	}
+	op := strings.TrimSpace(doc[start:end])
+	for _, group := range operatorGroups {
+		for _, o := range group.ops {
+			if o == op {
+				return op
+			}
+		}
+	}
+	return ""
+}
+
+// Members of a class body are kept in this order: fields, the constructor,
+// accessors, operator overloads and then everything else. Generated members
+// go after the last existing member of the same or an earlier rank.
+const (
+	rankField = iota
+	rankConstructor
+	rankAccessor
+	rankOperator
+	rankMethod
+)
+
+func memberRank(stmt *Statement) int {
+	switch {
+	case stmt.FieldDefinition != nil:
+		return rankField
+	case stmt.FunctionDefinition != nil:
+		name := stmt.FunctionDefinition.Name
+		switch {
+		case name.Op:
+			return rankOperator
+		case name.Get, name.Set:
+			return rankAccessor
+		case name.Name.Value == "constructor":
+			return rankConstructor
+		}
+	}
+	return rankMethod
+}
+
+// classBody describes where and how members are written into a class.
+type classBody struct {
+	stmt   *Statement
+	class  *ClassDefinition
+	open   int // offset just past the opening brace
+	indent string
+	unit   string
+}
+
+func newClassBody(doc string, stmt *Statement) *classBody {
+	spans := braceSpans(stmt.Tokens)
+	if len(spans) == 0 {
+		return nil
+	}
+
+	body := &classBody{stmt: stmt, class: stmt.ClassDefinition, open: spans[0][0] + 1, unit: "\t"}
+	classIndent := lineIndent(doc, stmt.Pos.Offset)
+	body.indent = classIndent + body.unit
+	if len(body.class.Body) > 0 {
+		if indent := lineIndent(doc, body.class.Body[0].Pos.Offset); len(indent) > len(classIndent) && strings.HasPrefix(indent, classIndent) {
+			body.indent, body.unit = indent, indent[len(classIndent):]
+		}
+	}
+	return body
+}
+
+// insert returns the edit adding members of the given rank to the class.
+func (cb *classBody) insert(doc string, rank int, members []string) lsp.TextEdit {
+	at := -1
+	for _, stmt := range cb.class.Body {
+		if memberRank(stmt) <= rank {
+			at = statementEnd(stmt)
+		}
+	}
+
+	var text strings.Builder
+	for i, m := range members {
+		if at >= 0 || i > 0 {
+			text.WriteString("\n")
+		}
+		text.WriteString("\n" + reindent(m, "", cb.indent))
+	}
+	if at < 0 {
+		at = cb.open
+		if len(cb.class.Body) > 0 {
+			text.WriteString("\n")
+		}
+	}
+
+	return lsp.TextEdit{Range: offsetRange(doc, at, at), NewText: text.String()}
+}
+
+func (cb *classBody) fields() []*FieldDefinition {
+	var fields []*FieldDefinition
+	for _, stmt := range cb.class.Body {
+		if stmt.FieldDefinition != nil {
+			fields = append(fields, stmt.FieldDefinition)
+		}
+	}
+	return fields
+}
+
+// selectedFields returns the fields overlapping [start, end), or every field
+// of the class when the selection does not cover any.
+func (cb *classBody) selectedFields(start, end int) []*FieldDefinition {
+	var fields []*FieldDefinition
+	for _, stmt := range cb.class.Body {
+		if stmt.FieldDefinition != nil && stmt.Pos.Offset < end && start < statementEnd(stmt) {
+			fields = append(fields, stmt.FieldDefinition)
+		}
+	}
+	if len(fields) == 0 {
+		return cb.fields()
+	}
+	return fields
+}
+
+func (cb *classBody) method(match func(FuncName) bool) *FunctionDefinition {
+	for _, stmt := range cb.class.Body {
+		if stmt.FunctionDefinition != nil && match(stmt.FunctionDefinition.Name) {
+			return stmt.FunctionDefinition
+		}
+	}
+	return nil
+}
+
+func (s *Server) classActions(uri lsp.DocumentURI, doc string, prog *Program, rng lsp.Range, only []lsp.CodeActionKind) []CodeAction {
+	actions := []CodeAction{}
+	start, end := positionToOffset(doc, rng.Start), positionToOffset(doc, rng.End)
+
+	var stmt *Statement
+	forEachStatement(prog.Statements, func(st *Statement) {
+		if st.ClassDefinition != nil && st.Pos.Offset <= start && start <= statementEnd(st) {
+			stmt = st
+		}
+	})
+	if stmt == nil {
+		return actions
+	}
+	cb := newClassBody(doc, stmt)
+	if cb == nil {
+		return actions
+	}
+	this := cb.class.Name.Value
+	fields := cb.selectedFields(start, end)
+
+	if wantsKind(only, CAKSourceGenerateConstructor) && len(fields) > 0 && cb.method(func(n FuncName) bool { return n.Name.Value == "constructor" }) == nil {
+		var params, body []string
+		for _, f := range fields {
+			params = append(params, f.Name.Value+": "+f.Type.Value)
+			body = append(body, cb.unit+"this."+f.Name.Value+" = "+f.Name.Value+";")
+		}
+		ctor := "func constructor(" + strings.Join(params, ", ") + ") {\n" + strings.Join(body, "\n") + "\n}"
+		actions = append(actions, CodeAction{
+			Title:   fmt.Sprintf("Generate constructor for '%s'", this),
+			Kind:    CAKSourceGenerateConstructor,
+			Edit:    singleEdit(uri, cb.insert(doc, rankConstructor, []string{ctor})),
+			sources: []Node{stmt},
+		})
+	}
+
+	if wantsKind(only, CAKSourceGenerateAccessors) {
+		var accessors []string
+		for _, f := range fields {
+			if !f.Private {
+				continue
+			}
+			name, typ := f.Name.Value, f.Type.Value
+			if cb.method(func(n FuncName) bool { return n.Get && n.Name.Value == name }) == nil {
+				accessors = append(accessors, "func get "+name+"(): "+typ+" {\n"+cb.unit+"return this."+name+";\n}")
+			}
+			if cb.method(func(n FuncName) bool { return n.Set && n.Name.Value == name }) == nil {
+				accessors = append(accessors, "func set "+name+"(value: "+typ+") {\n"+cb.unit+"this."+name+" = value;\n}")
+			}
+		}
+		if len(accessors) > 0 {
+			actions = append(actions, CodeAction{
+				Title:   fmt.Sprintf("Generate getters and setters for '%s'", this),
+				Kind:    CAKSourceGenerateAccessors,
+				Edit:    singleEdit(uri, cb.insert(doc, rankAccessor, accessors)),
+				sources: []Node{stmt},
+			})
+		}
+	}
+
+	if wantsKind(only, CAKSourceGenerateOperators) {
+		stub := func(op string) string {
+			if cb.method(func(n FuncName) bool { return n.Op && strings.Trim(n.String, "\"") == op }) != nil {
+				return ""
+			}
+			ret, value := this, "new "+this+"()"
+			switch op {
+			case "==", "!=", "<", "<=", ">", ">=":
+				ret, value = "bool", "false"
+			}
+			return "func op \"" + op + "\"(other: " + this + "): " + ret + " {\n" +
+				cb.unit + "// TODO: implement \"" + op + "\"\n" +
+				cb.unit + "return " + value + ";\n}"
+		}
+		if op := selectedOperator(doc, start, end); op != "" {
+			if text := stub(op); text != "" {
+				actions = append(actions, CodeAction{
+					Title:   fmt.Sprintf("Generate operator \"%s\" for '%s'", op, this),
+					Kind:    CAKSourceGenerateOperators,
+					Edit:    singleEdit(uri, cb.insert(doc, rankOperator, []string{text})),
+					sources: []Node{stmt},
+				})
+			}
+		} else {
+			for _, group := range operatorGroups {
+				var stubs []string
+				for _, op := range group.ops {
+					if text := stub(op); text != "" {
+						stubs = append(stubs, text)
+					}
+				}
+				if len(stubs) > 0 {
+					actions = append(actions, CodeAction{
+						Title:   fmt.Sprintf("Generate %s operators for '%s'", group.name, this),
+						Kind:    CAKSourceGenerateOperators,
+						Edit:    singleEdit(uri, cb.insert(doc, rankOperator, stubs)),
+						sources: []Node{stmt},
+					})
+				}
+			}
+		}
+	}
+
+	return actions
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/vyPal/go-lsp"
+)
+
+func TestClassMembersInsertedByRank(t *testing.T) {
+	src := `package main;
+
+class P {
+	private x: i32;
+
+	func constructor(x: i32) {
+		this.x = x;
+	}
+
+	func dist(o: P): i32 {
+		return this.x - o.x;
+	}
+}
+`
+	tests := []struct {
+		title string
+		kind  lsp.CodeActionKind
+		rng   lsp.Range
+		want  string
+	}{
+		{"Generate getters and setters for 'P'", CAKSourceGenerateAccessors, lspRange(3, 10, 3, 10), `package main;
+
+class P {
+	private x: i32;
+
+	func constructor(x: i32) {
+		this.x = x;
+	}
+
+	func get x(): i32 {
+		return this.x;
+	}
+
+	func set x(value: i32) {
+		this.x = value;
+	}
+
+	func dist(o: P): i32 {
+		return this.x - o.x;
+	}
+}
+`},
+		{`Generate operator "-" for 'P'`, CAKSourceGenerateOperators, lspRange(10, 16, 10, 16), `package main;
+
+class P {
+	private x: i32;
+
+	func constructor(x: i32) {
+		this.x = x;
+	}
+
+	func op "-"(other: P): P {
+		// TODO: implement "-"
+		return new P();
+	}
+
+	func dist(o: P): i32 {
+		return this.x - o.x;
+	}
+}
+`},
+	}
+	s, dir := newTestServer(t, map[string]string{"main.cffc": src})
+	uri := openDocument(t, s, dir, "main.cffc")
+	for _, tt := range tests {
+		actions := codeActions(t, s, uri, tt.rng, tt.kind)
+		if got := applyAction(t, s, uri, findAction(t, actions, tt.title)); got != tt.want {
+			t.Errorf("%s: got\n%s\nwant\n%s", tt.title, got, tt.want)
+		}
+	}
+}
+
+func TestConstructorInsertedAfterLastField(t *testing.T) {
+	src := `package main;
+
+class P {
+	func dist(o: P): i32 {
+		return 0;
+	}
+	x: i32;
+}
+`
+	want := `package main;
+
+class P {
+	func dist(o: P): i32 {
+		return 0;
+	}
+	x: i32;
+
+	func constructor(x: i32) {
+		this.x = x;
+	}
+}
+`
+	s, dir := newTestServer(t, map[string]string{"main.cffc": src})
+	uri := openDocument(t, s, dir, "main.cffc")
+	actions := codeActions(t, s, uri, lspRange(6, 1, 6, 1), CAKSourceGenerateConstructor)
+	if got := applyAction(t, s, uri, findAction(t, actions, "Generate constructor for 'P'")); got != want {
+		t.Errorf("got\n%s\nwant\n%s", got, want)
+	}
+}
+
+func TestOperatorsOfferedByGroup(t *testing.T) {
+	src := `package main;
+
+class P {
+	x: i32;
+
+	func op "+"(other: P): P {
+		return other;
+	}
+}
+`
+	s, dir := newTestServer(t, map[string]string{"main.cffc": src})
+	uri := openDocument(t, s, dir, "main.cffc")
+	actions := codeActions(t, s, uri, lspRange(2, 7, 2, 7), CAKSourceGenerateOperators)
+	var titles []string
+	for _, a := range actions {
+		titles = append(titles, a.Title)
+	}
+	want := []string{"Generate arithmetic operators for 'P'", "Generate comparison operators for 'P'"}
+	if len(titles) != len(want) || titles[0] != want[0] || titles[1] != want[1] {
+		t.Fatalf("got %q, want %q", titles, want)
+	}
+
+	// The arithmetic group skips the operator the class already has.
+	got := applyAction(t, s, uri, actions[0])
+	if n := strings.Count(got, `func op "+"`); n != 1 {
+		t.Errorf(`got %d definitions of "+", want 1`, n)
+	}
+	if n := strings.Count(got, `func op "%"`); n != 1 {
+		t.Errorf(`got %d definitions of "%%", want 1`, n)
+	}
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/vyPal/go-lsp"
+)
+
+// ExecuteCommand runs one of the commands listed in the server's
+// executeCommandProvider capability.
+func (s *Server) ExecuteCommand(ctx context.Context, params lsp.ExecuteCommandParams) (interface{}, error) {
+	switch params.Command {
+	case CompletionAcceptedCommand:
+		if len(params.Arguments) > 0 {
+			if label, ok := params.Arguments[0].(string); ok {
+				s.CompletionAccepted(label)
+			}
+		}
+		return nil, nil
+	case RunProjectCommand, BuildProjectCommand, StopProjectCommand:
+		if len(params.Arguments) == 0 {
+			return nil, fmt.Errorf("%s needs the path of a cfconf.yaml", params.Command)
+		}
+		config, ok := params.Arguments[0].(string)
+		if !ok {
+			return nil, fmt.Errorf("%s needs the path of a cfconf.yaml", params.Command)
+		}
+		if params.Command == StopProjectCommand {
+			go s.stopCaffeineC(config)
+			return nil, nil
+		}
+		verb := "run"
+		if params.Command == BuildProjectCommand {
+			verb = "build"
+		}
+		// Builds take a while; report the outcome once it is done.
+		go s.runCaffeineC(verb, config)
+		return nil, nil
+	}
+	return nil, fmt.Errorf("unknown command: %s", params.Command)
+}
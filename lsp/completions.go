@@ -1,46 +1,547 @@
 package main
 
-import "github.com/vyPal/go-lsp"
-
-func GenerateCompletions(params *lsp.CompletionParams) *lsp.CompletionList {
-	list := &lsp.CompletionList{}
-
-	// Keyword completions
-	list.Items = append(list.Items, lsp.CompletionItem{
-		Label:  "var",
-		Detail: "Declare a variable",
-		Kind:   lsp.CIKKeyword,
-	})
-
-	list.Items = append(list.Items, lsp.CompletionItem{
-		Label:  "func",
-		Detail: "Define a function",
-		Kind:   lsp.CIKKeyword,
-	})
-
-	list.Items = append(list.Items, lsp.CompletionItem{
-		Label:  "class",
-		Detail: "Define a class",
-		Kind:   lsp.CIKKeyword,
-	})
-
-	list.Items = append(list.Items, lsp.CompletionItem{
-		Label:  "if",
-		Detail: "Start an if statement",
-		Kind:   lsp.CIKKeyword,
-	})
-
-	list.Items = append(list.Items, lsp.CompletionItem{
-		Label:  "for",
-		Detail: "Start a for loop",
-		Kind:   lsp.CIKKeyword,
-	})
-
-	list.Items = append(list.Items, lsp.CompletionItem{
-		Label:  "while",
-		Detail: "Start a while loop",
-		Kind:   lsp.CIKKeyword,
-	})
-
-	return list
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"github.com/vyPal/go-lsp"
+)
+
+// CompletionItem adds the completion fields that go-lsp does not model.
+// Documentation and Data shadow the go-lsp fields of the same name.
+type CompletionItem struct {
+	lsp.CompletionItem
+	Documentation       interface{}     `json:"documentation,omitempty"`
+	AdditionalTextEdits []lsp.TextEdit  `json:"additionalTextEdits,omitempty"`
+	Command             *lsp.Command    `json:"command,omitempty"`
+	Data                *completionData `json:"data,omitempty"`
+
+	tier int
+}
+
+type CompletionList struct {
+	IsIncomplete bool             `json:"isIncomplete"`
+	Items        []CompletionItem `json:"items"`
+}
+
+func isIdentRune(r rune) bool {
+	return r == '_' || unicode.IsLetter(r) || unicode.IsDigit(r)
+}
+
+// completionContext is the syntactic position completion was requested in.
+type completionContext int
+
+const (
+	contextNone completionContext = iota
+	contextFile
+	contextStatement
+	contextClassBody
+	contextType
+	contextExpression
+	contextImportSymbol
+	contextImportPath
+	contextNew
+)
+
+var (
+	importSymbolPattern = regexp.MustCompile(`from\s*("[^"]*")\s*import\s*(\{[^}]*)?$`)
+	importPathPattern   = regexp.MustCompile(`(?:import|from)\s*"([^"]*)$`)
+)
+
+// completionContextAt classifies the cursor position from the text of the
+// line before it and the scope it falls in. For import symbols the imported
+// package is returned as well, for import paths the part already typed.
+func completionContextAt(text string, sc *Scope, offset int) (completionContext, string) {
+	if m := importPathPattern.FindStringSubmatch(text); m != nil {
+		return contextImportPath, m[1]
+	}
+
+	text = strings.TrimRightFunc(text, isIdentRune)
+	trimmed := strings.TrimRightFunc(text, unicode.IsSpace)
+
+	if m := importSymbolPattern.FindStringSubmatch(trimmed); m != nil {
+		return contextImportSymbol, strings.Trim(m[1], "\"")
+	}
+	if strings.HasSuffix(strings.TrimRight(trimmed, "* "), ":") {
+		return contextType, ""
+	}
+
+	// Names being declared cannot be completed.
+	last := trimmed[len(strings.TrimRightFunc(trimmed, isIdentRune)):]
+	switch last {
+	case "var", "func", "class", "get", "set", "package", "as":
+		return contextNone, ""
+	case "private", "static":
+		return contextClassBody, ""
+	case "export":
+		return contextFile, ""
+	case "new":
+		if trimmed != text {
+			return contextNew, ""
+		}
+	}
+	if trimmed != text && last != "" && last != "return" {
+		// An identifier followed by a space, as in `x ` or `else `.
+		return contextNone, ""
+	}
+
+	if trimmed != "" && !strings.HasSuffix(trimmed, "{") && !strings.HasSuffix(trimmed, "}") && !strings.HasSuffix(trimmed, ";") {
+		return contextExpression, ""
+	}
+	if sc == nil {
+		return contextFile, ""
+	}
+	switch inner := sc.Innermost(offset); {
+	case inner.Function != nil:
+		return contextStatement, ""
+	case inner.Class != nil:
+		return contextClassBody, ""
+	}
+	return contextFile, ""
+}
+
+func keyword(label, detail string) CompletionItem {
+	return CompletionItem{CompletionItem: lsp.CompletionItem{Label: label, Kind: lsp.CIKKeyword, Detail: detail}}
+}
+
+func snippet(label, detail, body string) CompletionItem {
+	return CompletionItem{CompletionItem: lsp.CompletionItem{
+		Label:            label,
+		Kind:             lsp.CIKSnippet,
+		Detail:           detail,
+		InsertText:       body,
+		InsertTextFormat: lsp.ITFSnippet,
+	}}
+}
+
+var fileCompletions = []CompletionItem{
+	snippet("import", "Import a package", "import \"${1:package}\";"),
+	snippet("from import", "Import symbols from a package", "from \"${1:package}\" import { $0 };"),
+	keyword("export", "Export a declaration"),
+	snippet("extern", "Declare an external function", "extern func ${1:name}($2): ${3:void};"),
+	snippet("func", "Define a function", "func ${1:name}($2): ${3:void} {\n\t$0\n}"),
+	snippet("class", "Define a class", "class ${1:Name} {\n\t$0\n}"),
+	snippet("var", "Declare a variable", "var ${1:name}: ${2:i32} = $0;"),
+	snippet("const var", "Declare a constant", "const var ${1:name}: ${2:i32} = $0;"),
+}
+
+var statementCompletions = []CompletionItem{
+	snippet("var", "Declare a variable", "var ${1:name}: ${2:i32} = $0;"),
+	snippet("const var", "Declare a constant", "const var ${1:name}: ${2:i32} = $0;"),
+	snippet("if", "Start an if statement", "if (${1:condition}) {\n\t$0\n}"),
+	snippet("if else", "Start an if/else statement", "if (${1:condition}) {\n\t$2\n} else {\n\t$0\n}"),
+	snippet("for", "Start a for loop", "for (var ${1:i}: i32 = 0; $1 < ${2:n}; $1 = $1 + 1) {\n\t$0\n}"),
+	snippet("while", "Start a while loop", "while (${1:condition}) {\n\t$0\n}"),
+	snippet("return", "Return from the function", "return $0;"),
+	snippet("break", "Leave the loop", "break;"),
+	snippet("continue", "Start the next iteration", "continue;"),
+}
+
+var classBodyCompletions = []CompletionItem{
+	keyword("private", "Restrict a member to its class"),
+	keyword("static", "Define a method on the class itself"),
+	keyword("vararg", "Accept a variable number of arguments"),
+	snippet("field", "Declare a field", "${1:name}: ${2:i32};"),
+	snippet("func", "Define a method", "func ${1:name}($2): ${3:void} {\n\t$0\n}"),
+	snippet("constructor", "Define the constructor", "func constructor($1) {\n\t$0\n}"),
+	snippet("func get", "Define a getter", "func get ${1:name}(): ${2:i32} {\n\treturn this.$1;\n}"),
+	snippet("func set", "Define a setter", "func set ${1:name}(value: ${2:i32}) {\n\tthis.$1 = value;\n}"),
+}
+
+var expressionCompletions = []CompletionItem{
+	keyword("true", "Boolean literal"),
+	keyword("false", "Boolean literal"),
+	keyword("null", "Null pointer"),
+	snippet("new", "Create a class instance", "new ${1:Class}($2)"),
+}
+
+// keywordCompletions returns the keywords and snippets that fit ctx. class is
+// the class enclosing the cursor, if any.
+func keywordCompletions(ctx completionContext, class *ClassDefinition) []CompletionItem {
+	var items []CompletionItem
+	switch ctx {
+	case contextFile:
+		items = append(items, fileCompletions...)
+	case contextStatement:
+		items = append(items, statementCompletions...)
+	case contextClassBody:
+		items = append(items, classBodyCompletions...)
+		if class != nil {
+			name := class.Name.Value
+			items = append(items, snippet("func op", "Overload an operator", "func op \"${1:+}\"(${2:other}: "+name+"): ${3:"+name+"} {\n\t$0\n}"))
+		}
+	case contextExpression:
+		items = append(items, expressionCompletions...)
+	}
+
+	if class != nil && (ctx == contextStatement || ctx == contextExpression) {
+		items = append(items, keyword("this", "The current "+class.Name.Value))
+	}
+	return items
+}
+
+var classPattern = regexp.MustCompile(`(?m)^[ \t]*(?:export[ \t]+)?class[ \t]+([A-Za-z_][A-Za-z0-9_]*)`)
+
+// classCandidate is a class that can be named from a document.
+type classCandidate struct {
+	name string
+	file string
+	line int
+}
+
+// reachableClasses lists the classes declared in a document or brought in by
+// its imports. Declarations are also picked up from the raw text so classes
+// typed since the last successful parse are not missed.
+func (s *Server) reachableClasses(uri lsp.DocumentURI, doc string, prog *Program) []classCandidate {
+	docPath := uriToPath(uri)
+	var classes []classCandidate
+	seen := make(map[string]bool)
+	add := func(c classCandidate) {
+		if !seen[c.name] {
+			seen[c.name] = true
+			classes = append(classes, c)
+		}
+	}
+
+	for _, m := range classPattern.FindAllStringSubmatchIndex(doc, -1) {
+		add(classCandidate{name: doc[m[2]:m[3]], file: docPath, line: strings.Count(doc[:m[2]], "\n") + 1})
+	}
+	if prog == nil {
+		return classes
+	}
+
+	for _, sym := range s.importedSymbols(uriToPath(uri), prog) {
+		if sym.Type != "class" {
+			continue
+		}
+		line := 0
+		if i := strings.LastIndex(sym.Data["location"], "#L"); i >= 0 {
+			line, _ = strconv.Atoi(sym.Data["location"][i+2:])
+		}
+		add(classCandidate{name: sym.Name, file: sym.Data["file"], line: line})
+	}
+	return classes
+}
+
+// typeCompletions offers type names for the word before the cursor, which may
+// start with `*`s. After `new` only classes are offered; in type positions
+// builtin types and pointers to every type are included as well.
+func (s *Server) typeCompletions(uri lsp.DocumentURI, doc string, prog *Program, pos lsp.Position, text string, where completionContext) []CompletionItem {
+	items := []CompletionItem{}
+	start := len(strings.TrimRight(strings.TrimRightFunc(text, isIdentRune), "*"))
+	rng := lsp.Range{Start: lsp.Position{Line: pos.Line, Character: encodedLen(text[:start])}, End: pos}
+
+	stars := []string{""}
+	if where == contextType {
+		stars = []string{"", "*", "**"}
+	}
+	add := func(name string, kind lsp.CompletionItemKind, detail string) {
+		for _, star := range stars {
+			label := star + name
+			items = append(items, CompletionItem{
+				CompletionItem: lsp.CompletionItem{
+					Label:      label,
+					Kind:       kind,
+					Detail:     detail,
+					FilterText: label,
+					TextEdit:   &lsp.TextEdit{Range: rng, NewText: label},
+				},
+				tier: len(star),
+			})
+		}
+	}
+
+	if where == contextType {
+		for _, t := range builtinTypes {
+			add(t, lsp.CIKTypeParameter, "builtin type")
+		}
+	}
+	docDir := filepath.Dir(uriToPath(uri))
+	for _, c := range s.reachableClasses(uri, doc, prog) {
+		file := c.file
+		if rel, err := filepath.Rel(docDir, file); err == nil {
+			file = rel
+		}
+		add(c.name, lsp.CIKClass, fmt.Sprintf("class %s (%s:%d)", c.name, file, c.line))
+	}
+	return items
+}
+
+// importSymbolCompletions offers the exports of pkg after `from "pkg" import`
+// and inside the braces of `from "pkg" import { ... }`, leaving out the
+// symbols already listed there.
+func (s *Server) importSymbolCompletions(uri lsp.DocumentURI, pkg, text string) []CompletionItem {
+	items := []CompletionItem{}
+	listed := make(map[string]bool)
+	if m := importSymbolPattern.FindStringSubmatch(strings.TrimRightFunc(text, isIdentRune)); m != nil && m[2] != "" {
+		for _, sym := range strings.Split(m[2][1:], ",") {
+			if fields := strings.Fields(sym); len(fields) > 0 {
+				listed[fields[0]] = true
+			}
+		}
+	} else {
+		items = append(items, snippet("{ }", "Import several symbols", "{ $0 };"))
+	}
+
+	file, err := resolveImportFile(pkg, filepath.Dir(uriToPath(uri)), cache)
+	if err != nil {
+		return items
+	}
+	imported, err := s.loadModule(file)
+	if err != nil {
+		return items
+	}
+	for _, sym := range exportedSymbols(imported, file) {
+		if listed[sym.Name] {
+			continue
+		}
+		kind := lsp.CIKFunction
+		if sym.Type == "class" {
+			kind = lsp.CIKClass
+		}
+		items = append(items, CompletionItem{CompletionItem: lsp.CompletionItem{Label: sym.Name, Kind: kind, Detail: sym.Type}})
+	}
+	return items
+}
+
+// receiverChain parses the member access being typed at the end of text, as
+// in `p.next.` or `this.items[i].`, and returns its identifiers. ok is false
+// when text does not end in a member access.
+func receiverChain(text string) (chain []string, ok bool) {
+	text = strings.TrimRightFunc(text, isIdentRune)
+	for strings.HasSuffix(text, ".") {
+		text = strings.TrimRightFunc(text[:len(text)-1], unicode.IsSpace)
+
+		// Skip a GEP index such as `[i + 1]`.
+		if strings.HasSuffix(text, "]") {
+			depth := 0
+			i := len(text) - 1
+			for ; i >= 0; i-- {
+				if text[i] == ']' {
+					depth++
+				} else if text[i] == '[' {
+					if depth--; depth == 0 {
+						break
+					}
+				}
+			}
+			if i < 0 {
+				return nil, false
+			}
+			text = text[:i]
+		}
+
+		rest := strings.TrimRightFunc(text, isIdentRune)
+		name := text[len(rest):]
+		if name == "" || unicode.IsDigit(rune(name[0])) {
+			return nil, false
+		}
+		chain = append([]string{name}, chain...)
+		text = rest
+	}
+	return chain, len(chain) > 0
+}
+
+// classScope finds the body scope of a class declared in the document or
+// exported by one of the modules it imports.
+func (s *Server) classScope(docPath string, prog *Program, sc *Scope, name string) *Scope {
+	name = strings.TrimLeft(name, "*")
+	if class := sc.ClassScope(name); class != nil {
+		return class
+	}
+
+	for _, stmt := range prog.Statements {
+		if stmt.Import == nil && stmt.FromImport == nil && stmt.FromImportMultiple == nil {
+			continue
+		}
+		symbol := name
+		switch {
+		case stmt.FromImport != nil:
+			if stmt.FromImport.Alias != name && stmt.FromImport.Symbol != name {
+				continue
+			}
+			symbol = stmt.FromImport.Symbol
+		case stmt.FromImportMultiple != nil:
+			found := false
+			for _, sym := range stmt.FromImportMultiple.Symbols {
+				if sym.Alias == name || sym.Name == name {
+					symbol, found = sym.Name, true
+				}
+			}
+			if !found {
+				continue
+			}
+		}
+
+		file, err := resolveImportFile(importedPackage(stmt), filepath.Dir(docPath), cache)
+		if err != nil {
+			continue
+		}
+		scopes, err := s.scopesOf(file)
+		if err != nil {
+			continue
+		}
+		if class := scopes.ClassScope(symbol); class != nil {
+			for _, b := range class.Parent.Bindings {
+				if b.Kind == "class" && b.Name == symbol && b.Exported {
+					return class
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// receiverClass resolves the class of a receiver such as `this.next` or
+// `p.v` as seen from offset. static reports that the receiver names the class
+// itself rather than an instance.
+func (s *Server) receiverClass(docPath string, prog *Program, sc *Scope, offset int, chain []string) (class *Scope, static bool) {
+	if chain[0] == "this" {
+		if cd := sc.EnclosingClass(offset); cd != nil {
+			class = s.classScope(docPath, prog, sc, cd.Name.Value)
+		}
+	} else if b := sc.Lookup(chain[0], offset); b != nil && b.Kind != "class" {
+		class = s.classScope(docPath, prog, sc, b.Type)
+	} else {
+		class, static = s.classScope(docPath, prog, sc, chain[0]), true
+	}
+
+	for _, name := range chain[1:] {
+		if class == nil {
+			return nil, false
+		}
+		member := class.Member(name)
+		if member == nil || member.Kind != "field" {
+			return nil, false
+		}
+		class, static = s.classScope(docPath, prog, class.root(), member.Type), false
+		if class == nil {
+			class = s.classScope(docPath, prog, sc, member.Type)
+		}
+	}
+	return class, static
+}
+
+// memberCompletions offers the fields and methods of the receiver in front of
+// the cursor. Private members are only offered inside the class itself and a
+// class name as receiver only offers its static methods.
+func (s *Server) memberCompletions(uri lsp.DocumentURI, doc string, prog *Program, pos lsp.Position, chain []string) []CompletionItem {
+	items := []CompletionItem{}
+	if prog == nil {
+		return items
+	}
+	offset := s.astOffset(uri, positionToOffset(doc, pos))
+	sc := BuildScopes(prog)
+
+	class, static := s.receiverClass(uriToPath(uri), prog, sc, offset, chain)
+	if class == nil {
+		return items
+	}
+
+	inside := false
+	if cd := sc.EnclosingClass(offset); cd != nil {
+		inside = cd.Name.Value == class.Class.Name.Value
+	}
+
+	seen := make(map[string]bool)
+	for _, b := range class.Bindings {
+		if seen[b.Name] || (b.Private && !inside) || b.Static != static {
+			continue
+		}
+
+		item := lsp.CompletionItem{Label: b.Name, Detail: b.Type}
+		switch b.Kind {
+		case "field":
+			item.Kind = lsp.CIKField
+		case "method":
+			fd := b.Node.(*FunctionDefinition)
+			if fd.Name.Op || b.Name == "constructor" {
+				continue
+			}
+			if fd.Name.Get || fd.Name.Set {
+				item.Kind = lsp.CIKProperty
+				if fd.Name.Set && len(fd.Parameters) > 0 {
+					item.Detail = fd.Parameters[0].Type.Value
+				}
+			} else {
+				item.Kind = lsp.CIKMethod
+				item.Detail = fmt.Sprintf("(%s): %s", formatParameters(fd.Parameters), b.Type)
+			}
+		default:
+			continue
+		}
+
+		seen[b.Name] = true
+		items = append(items, CompletionItem{CompletionItem: item})
+	}
+	return items
+}
+
+// importPathCompletions offers import strings for the part typed so far:
+// .cffc files and folders relative to the document, and every cached package
+// together with the .cffc files in its source directory. Paths are offered
+// without the .cffc extension, which the resolver adds back.
+func (s *Server) importPathCompletions(uri lsp.DocumentURI, pos lsp.Position, typed string) []CompletionItem {
+	items := []CompletionItem{}
+	rng := lsp.Range{Start: lsp.Position{Line: pos.Line, Character: pos.Character - encodedLen(typed)}, End: pos}
+	add := func(label string, kind lsp.CompletionItemKind, detail string) {
+		items = append(items, CompletionItem{CompletionItem: lsp.CompletionItem{
+			Label:      label,
+			Kind:       kind,
+			Detail:     detail,
+			FilterText: label,
+			TextEdit:   &lsp.TextEdit{Range: rng, NewText: label},
+		}})
+	}
+
+	docPath := uriToPath(uri)
+	if typed == "" || strings.HasPrefix(typed, ".") {
+		base := "./"
+		if i := strings.LastIndex(typed, "/"); i >= 0 {
+			base = typed[:i+1]
+		}
+		entries, _ := os.ReadDir(filepath.Join(filepath.Dir(docPath), filepath.FromSlash(base)))
+		for _, e := range entries {
+			name := e.Name()
+			switch {
+			case strings.HasPrefix(name, "."):
+			case e.IsDir():
+				add(base+name+"/", lsp.CIKFolder, "folder")
+			case strings.HasSuffix(name, ".cffc") && filepath.Join(filepath.Dir(docPath), filepath.FromSlash(base), name) != docPath:
+				add(base+strings.TrimSuffix(name, ".cffc"), lsp.CIKFile, name)
+			}
+		}
+	}
+
+	for _, pkg := range cache.PkgList {
+		detail := strings.TrimSpace(pkg.Name + " " + pkg.Version)
+		add(pkg.Identifier, lsp.CIKModule, detail)
+
+		conf, err := GetCfConf(pkg.Path)
+		if err != nil {
+			continue
+		}
+		if conf.SourceDir == "" {
+			conf.SourceDir = "src"
+		}
+		src := filepath.Join(pkg.Path, conf.SourceDir)
+		filepath.WalkDir(src, func(path string, d os.DirEntry, err error) error {
+			if err != nil || d.IsDir() || !strings.HasSuffix(path, ".cffc") {
+				return nil
+			}
+			rel, err := filepath.Rel(src, path)
+			if err != nil {
+				return nil
+			}
+			add(pkg.Identifier+"/"+filepath.ToSlash(strings.TrimSuffix(rel, ".cffc")), lsp.CIKFile, detail)
+			return nil
+		})
+	}
+
+	return items
 }
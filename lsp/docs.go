@@ -0,0 +1,81 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// scopesOf builds the scope tree of the module at file, remembering the file
+// on its file scope so bindings can be traced back to their source.
+func (s *Server) scopesOf(file string) (*Scope, error) {
+	prog, err := s.loadModule(file)
+	if err != nil {
+		return nil, err
+	}
+	sc := BuildScopes(prog)
+	sc.File = file
+	return sc, nil
+}
+
+// sourceOf returns the text the AST of a module was parsed from: the last
+// parsed text for open documents, the file contents otherwise.
+func (s *Server) sourceOf(file string) string {
+	if src, ok := s.parsed[string(pathToURI(file))]; ok {
+		return src
+	}
+	b, err := os.ReadFile(file)
+	if err != nil {
+		return ""
+	}
+	return string(b)
+}
+
+// docComment returns the block of `//` comments ending on the line above line
+// (1-based) with the comment markers removed. The lexer drops comments, so
+// they are read from the source text.
+func docComment(src string, line int) string {
+	lines := strings.Split(src, "\n")
+	var doc []string
+	for i := line - 2; i >= 0 && i < len(lines); i-- {
+		text := strings.TrimSpace(lines[i])
+		if !strings.HasPrefix(text, "//") {
+			break
+		}
+		text = strings.TrimPrefix(text, "//")
+		doc = append([]string{strings.TrimPrefix(text, " ")}, doc...)
+	}
+	return strings.TrimSpace(strings.Join(doc, "\n"))
+}
+
+// bindingFile returns the file a binding was declared in. Bindings from
+// scopes without a file belong to the document at docPath.
+func bindingFile(b *Binding, docPath string) string {
+	if file := b.Scope.root().File; file != "" {
+		return file
+	}
+	return docPath
+}
+
+// bindingDoc returns the documentation comment of a binding's declaration.
+func (s *Server) bindingDoc(b *Binding, docPath string) string {
+	return docComment(s.sourceOf(bindingFile(b, docPath)), b.Pos.Line)
+}
+
+// declarationMarkdown renders a declaration for hovers and completion
+// documentation: its signature, doc comment and where it is defined.
+func (s *Server) declarationMarkdown(b *Binding, signature, docPath string) string {
+	var md strings.Builder
+	fmt.Fprintf(&md, "```cffc\n%s\n```", signature)
+	if doc := s.bindingDoc(b, docPath); doc != "" {
+		fmt.Fprintf(&md, "\n\n%s", doc)
+	}
+
+	file := bindingFile(b, docPath)
+	if rel, err := filepath.Rel(filepath.Dir(docPath), file); err == nil {
+		file = rel
+	}
+	fmt.Fprintf(&md, "\n\nDefined in `%s:%d`", filepath.ToSlash(file), b.Pos.Line)
+	return md.String()
+}
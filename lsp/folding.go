@@ -0,0 +1,188 @@
+package main
+
+import (
+	"context"
+	"strings"
+
+	"github.com/alecthomas/participle/v2/lexer"
+	"github.com/vyPal/go-lsp"
+)
+
+type FoldingRangeParams struct {
+	TextDocument lsp.TextDocumentIdentifier `json:"textDocument"`
+}
+
+type FoldingRange struct {
+	StartLine int    `json:"startLine"`
+	EndLine   int    `json:"endLine"`
+	Kind      string `json:"kind,omitempty"`
+}
+
+const (
+	foldingComment = "comment"
+	foldingImports = "imports"
+	foldingRegion  = "region"
+)
+
+type SelectionRangeParams struct {
+	TextDocument lsp.TextDocumentIdentifier `json:"textDocument"`
+	Positions    []lsp.Position             `json:"positions"`
+}
+
+type SelectionRange struct {
+	Range  lsp.Range       `json:"range"`
+	Parent *SelectionRange `json:"parent,omitempty"`
+}
+
+// FoldingRange folds the bodies of functions, classes and control flow, runs
+// of imports and comments spanning several lines. A body folds up to the line
+// before its closing brace so the brace stays visible.
+func (s *Server) FoldingRange(ctx context.Context, params FoldingRangeParams) ([]FoldingRange, error) {
+	uri := params.TextDocument.URI
+	if isCfConf(uri) {
+		// Leave yaml to the editor's own folding.
+		return nil, nil
+	}
+	doc := s.documents[string(uri)]
+	ranges := []FoldingRange{}
+	line := func(offset int) int {
+		return offsetToPosition(doc, s.docOffset(uri, offset)).Line
+	}
+	add := func(start, end int, kind string) {
+		if end > start {
+			ranges = append(ranges, FoldingRange{StartLine: start, EndLine: end, Kind: kind})
+		}
+	}
+
+	if prog := s.asts[string(uri)]; prog != nil {
+		Inspect(prog, func(n Node) bool {
+			stmt, ok := n.(*Statement)
+			if ok && (stmt.FunctionDefinition != nil || stmt.ClassDefinition != nil || stmt.If != nil || stmt.For != nil || stmt.While != nil) {
+				// Else-if and else bodies are further top-level brace pairs of
+				// the if statement.
+				for _, span := range braceSpans(stmt.Tokens) {
+					add(line(span[0]), line(span[1]-1)-1, foldingRegion)
+				}
+			}
+			return true
+		})
+
+		first, last := -1, -1
+		for _, stmt := range append(prog.Statements, nil) {
+			if stmt != nil && (stmt.Import != nil || stmt.FromImport != nil || stmt.FromImportMultiple != nil) {
+				if first < 0 {
+					first = stmt.Pos.Offset
+				}
+				last = stmt.EndPos.Offset
+				continue
+			}
+			if first >= 0 {
+				add(line(first), line(last), foldingImports)
+				first = -1
+			}
+		}
+	}
+
+	// Comments are not part of the AST, so they are folded on the current text.
+	start, end := -1, -1
+	flush := func() {
+		if start >= 0 {
+			add(start, end, foldingComment)
+		}
+		start = -1
+	}
+	for _, t := range commentTokens(doc) {
+		first := offsetToPosition(doc, t.pos.Offset).Line
+		last := offsetToPosition(doc, t.pos.Offset+t.length).Line
+		lineStart := t.pos.Offset - t.pos.Column + 1
+		if strings.HasPrefix(doc[t.pos.Offset:], "//") && strings.TrimSpace(doc[lineStart:t.pos.Offset]) == "" {
+			// Line comments on consecutive lines of their own fold together.
+			if start < 0 || first != end+1 {
+				flush()
+				start = first
+			}
+			end = first
+			continue
+		}
+		flush()
+		add(first, last, foldingComment)
+	}
+	flush()
+	return ranges, nil
+}
+
+// SelectionRange answers every position with the chain of nodes enclosing
+// it, innermost first. Between a node with a body and the statements in it the
+// braces of that body form their own step.
+func (s *Server) SelectionRange(ctx context.Context, params SelectionRangeParams) ([]SelectionRange, error) {
+	uri := params.TextDocument.URI
+	doc := s.documents[string(uri)]
+	prog := s.asts[string(uri)]
+
+	result := []SelectionRange{}
+	for _, pos := range params.Positions {
+		offset := positionToOffset(doc, pos)
+		var spans [][2]int
+		if prog != nil {
+			spans = enclosingSpans(prog, s.astOffset(uri, offset))
+		}
+
+		var sel *SelectionRange
+		for _, span := range spans {
+			rng := offsetRange(doc, s.docOffset(uri, span[0]), s.docOffset(uri, span[1]))
+			if sel == nil || sel.Range != rng {
+				sel = &SelectionRange{Range: rng, Parent: sel}
+			}
+		}
+		if sel == nil {
+			sel = &SelectionRange{Range: offsetRange(doc, offset, offset)}
+		}
+		result = append(result, *sel)
+	}
+	return result, nil
+}
+
+// enclosingSpans returns the offsets of the nodes and bodies around offset,
+// outermost first. Where two siblings touch at offset the first one wins.
+func enclosingSpans(prog *Program, offset int) [][2]int {
+	var spans [][2]int
+	entered := make(map[Node]bool)
+	Walk(prog, func(n, parent Node) bool {
+		start, end := nodeOffsets(n)
+		if start > offset || offset > end || end == 0 || parent != nil && entered[parent] {
+			return false
+		}
+		if parent != nil {
+			entered[parent] = true
+		}
+		spans = append(spans, [2]int{start, end})
+
+		var tokens []lexer.Token
+		switch n := n.(type) {
+		case *FunctionDefinition:
+			tokens = n.Tokens
+		case *ClassDefinition:
+			tokens = n.Tokens
+		case *If:
+			// Else-if bodies belong to the ElseIf nodes below.
+			for _, t := range n.Tokens {
+				if len(n.ElseIf) == 0 || t.Pos.Offset < n.ElseIf[0].Pos.Offset || t.Pos.Offset >= n.ElseIf[len(n.ElseIf)-1].EndPos.Offset {
+					tokens = append(tokens, t)
+				}
+			}
+		case *ElseIf:
+			tokens = n.Tokens
+		case *For:
+			tokens = n.Tokens
+		case *While:
+			tokens = n.Tokens
+		}
+		for _, body := range braceSpans(tokens) {
+			if body[0] <= offset && offset <= body[1] {
+				spans = append(spans, body)
+			}
+		}
+		return true
+	}, nil)
+	return spans
+}
@@ -2,17 +2,21 @@ package main
 
 import (
 	"strconv"
+	"strings"
 
 	"github.com/alecthomas/participle/v2/lexer"
 )
 
+// IdentWithPos is a captured name, type or operator. Participle does not
+// position captured values, so parseProgram fills in its span.
 type IdentWithPos struct {
-	Pos   lexer.Position
-	Value string
+	Pos    lexer.Position
+	EndPos lexer.Position
+	Value  string
 }
 
 func (i *IdentWithPos) Capture(values []string) error {
-	i.Value = values[0]
+	i.Value = strings.Join(values, "")
 	return nil
 }
 
@@ -25,22 +29,27 @@ func (b *Bool) Capture(values []string) error {
 
 type Duration struct {
 	Pos    lexer.Position
+	EndPos lexer.Position
 	Number float64
 	Unit   string
 }
 
+// Capture is called once for the number and once for the unit.
 func (d *Duration) Capture(values []string) error {
-	num, err := strconv.ParseFloat(values[0], 64)
-	if err != nil {
-		return err
+	for _, v := range values {
+		if num, err := strconv.ParseFloat(v, 64); err == nil {
+			d.Number = num
+		} else {
+			d.Unit = v
+		}
 	}
-	d.Number = num
-	d.Unit = values[1]
 	return nil
 }
 
 type Value struct {
 	Pos      lexer.Position
+	EndPos   lexer.Position
+	Tokens   []lexer.Token
 	Float    *float64  `parser:"  @('-'? Float)"`
 	Duration *Duration `parser:"| @Int @('h' | 'm' | 's' | 'ms' | 'us' | 'ns')"`
 	Int      *int64    `parser:"| @('-'? Int)"`
@@ -51,33 +60,43 @@ type Value struct {
 }
 
 type Identifier struct {
-	Pos   lexer.Position
-	Ref   string      `parser:"@'&'*"`
-	Deref string      `parser:"@'*'*"`
-	Name  string      `parser:"@Ident"`
-	GEP   *Expression `parser:"('[' @@ ']')?"`
-	Sub   *Identifier `parser:"( '.' @@ )*"`
+	Pos    lexer.Position
+	EndPos lexer.Position
+	Tokens []lexer.Token
+	Ref    string      `parser:"@'&'*"`
+	Deref  string      `parser:"@'*'*"`
+	Name   string      `parser:"@Ident"`
+	GEP    *Expression `parser:"('[' @@ ']')?"`
+	Sub    *Identifier `parser:"( '.' @@ )*"`
 }
 
 type ArgumentList struct {
 	Pos       lexer.Position
+	EndPos    lexer.Position
+	Tokens    []lexer.Token
 	Arguments []*Expression `parser:"( @@ ( ',' @@ )* )?"`
 }
 
 type ClassInitializer struct {
 	Pos       lexer.Position
+	EndPos    lexer.Position
+	Tokens    []lexer.Token
 	ClassName IdentWithPos `parser:"@Ident"`
 	Args      ArgumentList `parser:"'(' @@ ')'"`
 }
 
 type FunctionCall struct {
 	Pos          lexer.Position
+	EndPos       lexer.Position
+	Tokens       []lexer.Token
 	FunctionName string       `parser:"@( Ident | String )"`
 	Args         ArgumentList `parser:"'(' @@ ')'"`
 }
 
 type Factor struct {
 	Pos              lexer.Position
+	EndPos           lexer.Position
+	Tokens           []lexer.Token
 	Value            *Value            `parser:"  @@"`
 	FunctionCall     *FunctionCall     `parser:"| (?= ( Ident | String ) '(') @@"`
 	BitCast          *BitCast          `parser:"| '(' @@"`
@@ -87,56 +106,74 @@ type Factor struct {
 }
 
 type BitCast struct {
-	Pos  lexer.Position
-	Expr *Expression `parser:"@@ ')'"`
-	Type string      `parser:"(':' @('*'* Ident))?"`
+	Pos    lexer.Position
+	EndPos lexer.Position
+	Tokens []lexer.Token
+	Expr   *Expression `parser:"@@ ')'"`
+	Type   string      `parser:"(':' @('*'* Ident))?"`
 }
 
 type Term struct {
-	Pos   lexer.Position
-	Left  *Factor   `parser:"@@"`
-	Right []*OpTerm `parser:"@@*"`
+	Pos    lexer.Position
+	EndPos lexer.Position
+	Tokens []lexer.Token
+	Left   *Factor   `parser:"@@"`
+	Right  []*OpTerm `parser:"@@*"`
 }
 
 type OpTerm struct {
-	Pos  lexer.Position
-	Op   IdentWithPos `parser:"@( '*' | '/' | '%' )"`
-	Term *Factor      `parser:"@@"`
+	Pos    lexer.Position
+	EndPos lexer.Position
+	Tokens []lexer.Token
+	Op     IdentWithPos `parser:"@( '*' | '/' | '%' )"`
+	Term   *Factor      `parser:"@@"`
 }
 
 type Comparison struct {
-	Pos   lexer.Position
-	Left  *Term           `parser:"@@"`
-	Right []*OpComparison `parser:"@@*"`
+	Pos    lexer.Position
+	EndPos lexer.Position
+	Tokens []lexer.Token
+	Left   *Term           `parser:"@@"`
+	Right  []*OpComparison `parser:"@@*"`
 }
 
 type OpComparison struct {
 	Pos        lexer.Position
+	EndPos     lexer.Position
+	Tokens     []lexer.Token
 	Op         IdentWithPos `parser:"@( ('=' '=') | ( '<' '=' ) | '<'  | ( '>' '=' ) |'>' | ('!' '=') )"`
 	Comparison *Term        `parser:"@@"`
 }
 
 type Expression struct {
-	Pos   lexer.Position
-	Left  *Comparison     `parser:"@@"`
-	Right []*OpExpression `parser:"@@*"`
+	Pos    lexer.Position
+	EndPos lexer.Position
+	Tokens []lexer.Token
+	Left   *Comparison     `parser:"@@"`
+	Right  []*OpExpression `parser:"@@*"`
 }
 
 type OpExpression struct {
 	Pos        lexer.Position
+	EndPos     lexer.Position
+	Tokens     []lexer.Token
 	Op         IdentWithPos `parser:"@( '+' | '-' | '&' '&' | '|' '|' )"`
 	Expression *Comparison  `parser:"@@"`
 }
 
 type Assignment struct {
-	Pos   lexer.Position
-	Left  *Identifier `parser:"@@"`
-	Right *Expression `parser:"'=' @@"`
+	Pos    lexer.Position
+	EndPos lexer.Position
+	Tokens []lexer.Token
+	Left   *Identifier `parser:"@@"`
+	Right  *Expression `parser:"'=' @@"`
 }
 
 type VariableDefinition struct {
 	Pos        lexer.Position
-	Constant   bool         `parser:"'const'?"`
+	EndPos     lexer.Position
+	Tokens     []lexer.Token
+	Constant   bool         `parser:"@'const'?"`
 	Name       IdentWithPos `parser:"'var' @Ident"`
 	Type       IdentWithPos `parser:"':' @('*'* Ident)"`
 	Assignment *Expression  `parser:"( '=' @@ )?"`
@@ -144,18 +181,25 @@ type VariableDefinition struct {
 
 type FieldDefinition struct {
 	Pos     lexer.Position
+	EndPos  lexer.Position
+	Tokens  []lexer.Token
 	Private bool         `parser:"@'private'?"`
 	Name    IdentWithPos `parser:"@Ident"`
 	Type    IdentWithPos `parser:"':' @('*'* Ident) ';'"`
 }
 
 type ArgumentDefinition struct {
-	Pos  lexer.Position
-	Name IdentWithPos `parser:"@Ident"`
-	Type IdentWithPos `parser:"':' @('*'* Ident)"`
+	Pos    lexer.Position
+	EndPos lexer.Position
+	Tokens []lexer.Token
+	Name   IdentWithPos `parser:"@Ident"`
+	Type   IdentWithPos `parser:"':' @('*'* Ident)"`
 }
 
 type FuncName struct {
+	Pos    lexer.Position
+	EndPos lexer.Position
+	Tokens []lexer.Token
 	Dummy  string       `parser:"'func'"`
 	Op     bool         `parser:"@'op'?"`
 	Get    bool         `parser:"@'get'?"`
@@ -166,6 +210,8 @@ type FuncName struct {
 
 type FunctionDefinition struct {
 	Pos        lexer.Position
+	EndPos     lexer.Position
+	Tokens     []lexer.Token
 	Private    bool                  `parser:"@'private'?"`
 	Static     bool                  `parser:"@'static'?"`
 	Variadic   bool                  `parser:"@'vararg'?"`
@@ -176,19 +222,25 @@ type FunctionDefinition struct {
 }
 
 type ClassDefinition struct {
-	Pos  lexer.Position
-	Name IdentWithPos `parser:"@Ident"`
-	Body []*Statement `parser:"'{' @@* '}'"`
+	Pos    lexer.Position
+	EndPos lexer.Position
+	Tokens []lexer.Token
+	Name   IdentWithPos `parser:"@Ident"`
+	Body   []*Statement `parser:"'{' @@* '}'"`
 }
 
 type ClassMethod struct {
 	Pos        lexer.Position
+	EndPos     lexer.Position
+	Tokens     []lexer.Token
 	Identifier *Identifier   `parser:"@@"`
 	Args       *ArgumentList `parser:"'(' @@ ')'"`
 }
 
 type If struct {
 	Pos       lexer.Position
+	EndPos    lexer.Position
+	Tokens    []lexer.Token
 	Condition *Expression  `parser:"'(' @@ ')'"`
 	Body      []*Statement `parser:"'{' @@* '}'"`
 	ElseIf    []*ElseIf    `parser:"( 'else' 'if' @@ )*"`
@@ -197,12 +249,16 @@ type If struct {
 
 type ElseIf struct {
 	Pos       lexer.Position
+	EndPos    lexer.Position
+	Tokens    []lexer.Token
 	Condition *Expression  `parser:"'(' @@ ')'"`
 	Body      []*Statement `parser:"'{' @@* '}'"`
 }
 
 type For struct {
 	Pos         lexer.Position
+	EndPos      lexer.Position
+	Tokens      []lexer.Token
 	Initializer *Statement   `parser:"'(' @@"`
 	Condition   *Expression  `parser:"@@ ';'"`
 	Increment   *Statement   `parser:"@@ ')'"`
@@ -211,17 +267,23 @@ type For struct {
 
 type While struct {
 	Pos       lexer.Position
+	EndPos    lexer.Position
+	Tokens    []lexer.Token
 	Condition *Expression  `parser:"'(' @@ ')'"`
 	Body      []*Statement `parser:"'{' @@* '}'"`
 }
 
 type Return struct {
 	Pos        lexer.Position
+	EndPos     lexer.Position
+	Tokens     []lexer.Token
 	Expression *Expression `parser:"@@? ';'"`
 }
 
 type ExternalFunctionDefinition struct {
 	Pos        lexer.Position
+	EndPos     lexer.Position
+	Tokens     []lexer.Token
 	Variadic   bool                  `parser:"@'vararg'?"`
 	Name       IdentWithPos          `parser:"'func' @( Ident | String )"`
 	Parameters []*ArgumentDefinition `parser:"'(' ( @@ ( ',' @@ )* )? ')'"`
@@ -229,27 +291,41 @@ type ExternalFunctionDefinition struct {
 }
 
 type Import struct {
+	Pos     lexer.Position
+	EndPos  lexer.Position
+	Tokens  []lexer.Token
 	Package string `parser:"@String ';'"`
 }
 
 type FromImport struct {
+	Pos     lexer.Position
+	EndPos  lexer.Position
+	Tokens  []lexer.Token
 	Package string `parser:"'from' @String 'import'"`
 	Symbol  string `parser:"@Ident"`
 	Alias   string `parser:"('as' @Ident)? ';'"`
 }
 
 type FromImportMultiple struct {
+	Pos     lexer.Position
+	EndPos  lexer.Position
+	Tokens  []lexer.Token
 	Package string   `parser:"'from' @String 'import' '{'"`
 	Symbols []Symbol `parser:"@@ (',' @@)* '}' ';'"`
 }
 
 type Symbol struct {
-	Name  string `parser:"@Ident"`
-	Alias string `parser:"('as' @Ident)?"`
+	Pos    lexer.Position
+	EndPos lexer.Position
+	Tokens []lexer.Token
+	Name   string `parser:"@Ident"`
+	Alias  string `parser:"('as' @Ident)?"`
 }
 
 type Statement struct {
 	Pos                lexer.Position
+	EndPos             lexer.Position
+	Tokens             []lexer.Token
 	VariableDefinition *VariableDefinition         `parser:"(?= 'const'? 'var' Ident) @@? (';' | '\\n')?"`
 	Assignment         *Assignment                 `parser:"| (?= Ident ( '[' ~']' ']' )? ( '.' Ident ( '[' ~']' ']' )? )* '=') @@? (';' | '\\n')?"`
 	External           *ExternalFunctionDefinition `parser:"| 'extern' @@ ';'"`
@@ -272,6 +348,8 @@ type Statement struct {
 
 type Program struct {
 	Pos        lexer.Position
+	EndPos     lexer.Position
+	Tokens     []lexer.Token
 	Package    string       `parser:"'package' @Ident ';'"`
 	Statements []*Statement `parser:"@@*"`
 }
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"context"
+	"sort"
+	"strings"
+
+	"github.com/alecthomas/participle/v2/lexer"
+	"github.com/vyPal/go-lsp"
+)
+
+// DocumentHighlight marks every occurrence in the document of the binding
+// under the cursor. Names are matched by resolving them in their scope, so a
+// shadowing local or a parameter of another function is left alone, and
+// members through the class of their receiver. The declaration of a variable
+// and plain assignments to it or to a member are writes, other declarations
+// are text and all remaining uses are reads.
+func (s *Server) DocumentHighlight(ctx context.Context, params lsp.TextDocumentPositionParams) ([]lsp.DocumentHighlight, error) {
+	uri := params.TextDocument.URI
+	doc, parsed := s.documents[string(uri)], s.parsed[string(uri)]
+	highlights := []lsp.DocumentHighlight{}
+	prog := s.asts[string(uri)]
+	if prog == nil {
+		return highlights, nil
+	}
+
+	file := uriToPath(uri)
+	offset := s.astOffset(uri, positionToOffset(doc, params.Position))
+	sc := BuildScopes(prog)
+
+	// Members are resolved through the class of their receiver, `this.x = ...`
+	// writes x and every other member access reads it.
+	type memberUse struct {
+		b    *Binding
+		name lexer.Token
+		kind lsp.DocumentHighlightKind
+	}
+	var members []memberUse
+	addMember := func(iden *Identifier, offset int, kind lsp.DocumentHighlightKind) {
+		var chain []string
+		last := iden
+		for i := iden; i != nil; i = i.Sub {
+			chain, last = append(chain, i.Name), i
+		}
+		if len(chain) < 2 {
+			return
+		}
+		t, ok := nameToken(last.Tokens, last.Name)
+		if !ok {
+			return
+		}
+		if class, _ := s.receiverClass(file, prog, sc, offset, chain[:len(chain)-1]); class != nil {
+			if b := class.Member(last.Name); b != nil {
+				members = append(members, memberUse{b, t, kind})
+			}
+		}
+	}
+	forEachStatement(prog.Statements, func(stmt *Statement) {
+		if stmt.Assignment != nil && stmt.Assignment.Left.Deref == "" {
+			addMember(stmt.Assignment.Left, stmt.Pos.Offset, lsp.Write)
+		}
+	})
+	forEachFactor(prog.Statements, func(fact *Factor) {
+		switch {
+		case fact.ClassMethod != nil:
+			addMember(fact.ClassMethod.Identifier, fact.Pos.Offset, lsp.Read)
+		case fact.Identifier != nil:
+			addMember(fact.Identifier, fact.Pos.Offset, lsp.Read)
+		}
+	})
+
+	target, _ := bindingAt(prog, sc, offset)
+	for _, m := range members {
+		if target == nil && tokenContains(m.name, offset) {
+			target = m.b
+		}
+	}
+	if target == nil {
+		return highlights, nil
+	}
+
+	kinds := make(map[int]lsp.DocumentHighlightKind)
+	ends := make(map[int]int)
+	add := func(start, end int, kind lsp.DocumentHighlightKind) {
+		if end > start && kind > kinds[start] {
+			kinds[start], ends[start] = kind, end
+		}
+	}
+	addName := func(tokens []lexer.Token, spelled string, offset int, kind lsp.DocumentHighlightKind) {
+		if t, ok := nameToken(tokens, spelled); ok && sc.Lookup(strings.Trim(spelled, "\""), offset) == target {
+			add(t.Pos.Offset, t.Pos.Offset+len(t.Value), kind)
+		}
+	}
+
+	if name := declarationName(target); name != nil {
+		kind := lsp.Text
+		if _, ok := target.Node.(*VariableDefinition); ok {
+			kind = lsp.Write
+		}
+		add(name.Pos.Offset, name.EndPos.Offset, kind)
+	}
+
+	forEachStatement(prog.Statements, func(stmt *Statement) {
+		if stmt.Assignment != nil {
+			left := stmt.Assignment.Left
+			kind := lsp.Read
+			if left.Sub == nil && left.Deref == "" {
+				// Assigning to a member or through a pointer only reads the name.
+				kind = lsp.Write
+			}
+			addName(left.Tokens, left.Name, stmt.Pos.Offset, kind)
+		}
+		if target.Kind == "class" {
+			for _, t := range statementTypes(stmt) {
+				if strings.TrimLeft(t.Value, "*") == target.Name {
+					add(t.EndPos.Offset-len(target.Name), t.EndPos.Offset, lsp.Read)
+				}
+			}
+		}
+	})
+	forEachFactor(prog.Statements, func(fact *Factor) {
+		switch {
+		case fact.FunctionCall != nil:
+			addName(fact.Tokens, fact.FunctionCall.FunctionName, fact.Pos.Offset, lsp.Read)
+		case fact.ClassMethod != nil:
+			addName(fact.ClassMethod.Identifier.Tokens, fact.ClassMethod.Identifier.Name, fact.Pos.Offset, lsp.Read)
+		case fact.Identifier != nil:
+			addName(fact.Identifier.Tokens, fact.Identifier.Name, fact.Pos.Offset, lsp.Read)
+		case fact.ClassInitializer != nil:
+			addName(fact.Tokens, fact.ClassInitializer.ClassName.Value, fact.Pos.Offset, lsp.Read)
+		}
+	})
+
+	for _, m := range members {
+		if m.b == target {
+			add(m.name.Pos.Offset, m.name.Pos.Offset+len(m.name.Value), m.kind)
+		}
+	}
+
+	for start, kind := range kinds {
+		end := ends[start]
+		from, to := s.docOffset(uri, start), s.docOffset(uri, end)
+		if to > len(doc) || end > len(parsed) || doc[from:to] != parsed[start:end] {
+			// The occurrence was edited since the last successful parse.
+			continue
+		}
+		highlights = append(highlights, lsp.DocumentHighlight{Range: offsetRange(doc, from, to), Kind: int(kind)})
+	}
+	sort.Slice(highlights, func(i, j int) bool {
+		return comparePositions(highlights[i].Range.Start, highlights[j].Range.Start) < 0
+	})
+	return highlights, nil
+}
+
+// declarationName returns the name written in the declaration of b, or nil
+// when it has none, like an operator overload.
+func declarationName(b *Binding) *IdentWithPos {
+	var name *IdentWithPos
+	switch n := b.Node.(type) {
+	case *VariableDefinition:
+		name = &n.Name
+	case *FieldDefinition:
+		name = &n.Name
+	case *ArgumentDefinition:
+		name = &n.Name
+	case *ClassDefinition:
+		name = &n.Name
+	case *FunctionDefinition:
+		name = &n.Name.Name
+	case *ExternalFunctionDefinition:
+		name = &n.Name
+	}
+	if name == nil || name.Value == "" || name.EndPos.Offset == 0 {
+		return nil
+	}
+	return name
+}
+
+// statementTypes returns the type names written by the declaration in stmt.
+func statementTypes(stmt *Statement) []*IdentWithPos {
+	var types []*IdentWithPos
+	add := func(t *IdentWithPos) {
+		if t.Value != "" && t.EndPos.Offset > 0 {
+			types = append(types, t)
+		}
+	}
+	switch {
+	case stmt.VariableDefinition != nil:
+		add(&stmt.VariableDefinition.Type)
+	case stmt.FieldDefinition != nil:
+		add(&stmt.FieldDefinition.Type)
+	case stmt.FunctionDefinition != nil:
+		for _, p := range stmt.FunctionDefinition.Parameters {
+			add(&p.Type)
+		}
+		add(&stmt.FunctionDefinition.ReturnType)
+	case stmt.External != nil:
+		for _, p := range stmt.External.Parameters {
+			add(&p.Type)
+		}
+		add(&stmt.External.ReturnType)
+	}
+	return types
+}
@@ -0,0 +1,447 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/alecthomas/participle/v2/lexer"
+	"github.com/vyPal/go-lsp"
+)
+
+var durationUnitsInNanos = map[string]int64{
+	"ns": int64(time.Nanosecond),
+	"us": int64(time.Microsecond),
+	"ms": int64(time.Millisecond),
+	"s":  int64(time.Second),
+	"m":  int64(time.Minute),
+	"h":  int64(time.Hour),
+}
+
+// importHover describes what an import string resolves to, including the
+// cfconf.yaml metadata of cached packages.
+func importHover(uri lsp.DocumentURI, pkg string) string {
+	docDir := filepath.Dir(uriToPath(uri))
+	file, err := resolveImportFile(pkg, docDir, cache)
+	if err != nil {
+		return ""
+	}
+	if rel, err := filepath.Rel(docDir, file); err == nil && !strings.HasPrefix(rel, "..") {
+		file = rel
+	}
+
+	found, p, _, err := cache.ResolvePackage(pkg)
+	if err != nil || !found {
+		return fmt.Sprintf("### Module\n\n**Import:** `%s`\n\n**File:** `%s`", pkg, filepath.ToSlash(file))
+	}
+
+	conf, err := GetCfConf(p.Path)
+	if err != nil {
+		return fmt.Sprintf("### Package `%s`\n\n**Version:** `%s`\n\n**File:** `%s`", p.Identifier, p.Version, filepath.ToSlash(file))
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "### Package %s\n\n", conf.Name)
+	if conf.Description != "" {
+		fmt.Fprintf(&b, "%s\n\n", conf.Description)
+	}
+	fmt.Fprintf(&b, "**Identifier:** `%s`\n\n", p.Identifier)
+	if conf.Version != "" {
+		fmt.Fprintf(&b, "**Version:** `%s`\n\n", conf.Version)
+	}
+	if conf.Author != "" {
+		fmt.Fprintf(&b, "**Author:** %s\n\n", conf.Author)
+	}
+	if conf.License != "" {
+		fmt.Fprintf(&b, "**License:** %s\n\n", conf.License)
+	}
+	fmt.Fprintf(&b, "**File:** `%s`", filepath.ToSlash(file))
+	return b.String()
+}
+
+// numberHover shows integer and hex literals in decimal, hex and binary, and
+// duration literals in nanoseconds and as a human readable duration.
+func numberHover(token string) string {
+	digits := strings.TrimRight(token, "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ_")
+	unit := token[len(digits):]
+
+	if strings.HasPrefix(token, "0x") {
+		n, err := strconv.ParseUint(token[2:], 16, 64)
+		if err != nil {
+			return ""
+		}
+		return integerHover(token, n)
+	}
+	if strings.Contains(digits, ".") {
+		return ""
+	}
+
+	n, err := strconv.ParseUint(digits, 10, 64)
+	if err != nil {
+		return ""
+	}
+	if unit == "" {
+		return integerHover(token, n)
+	}
+
+	scale, ok := durationUnitsInNanos[unit]
+	if !ok {
+		return ""
+	}
+	ns := int64(n) * scale
+	if scale != 0 && ns/scale != int64(n) {
+		return fmt.Sprintf("### Duration\n\n```cffc\n%s\n```\n\nOverflows an i64 nanosecond count.", token)
+	}
+	return fmt.Sprintf("### Duration\n\n```cffc\n%s\n```\n\n**Nanoseconds:** `%d`\n\n**Duration:** `%s`", token, ns, time.Duration(ns))
+}
+
+func integerHover(token string, n uint64) string {
+	return fmt.Sprintf("### Integer\n\n```cffc\n%s\n```\n\n**Decimal:** `%d`\n\n**Hex:** `0x%X`\n\n**Binary:** `0b%b`", token, n, n, n)
+}
+
+// classHover lists the fields and method signatures of a class together with
+// its doc comment.
+func (s *Server) classHover(class *Scope, docPath string) string {
+	var decl *Binding
+	for _, d := range class.Parent.Bindings {
+		if d.Kind == "class" && d.Node == class.Class {
+			decl = d
+		}
+	}
+	if decl == nil {
+		return ""
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "class %s {\n", class.Class.Name.Value)
+	for _, member := range class.Bindings {
+		if member.Kind == "field" {
+			fmt.Fprintf(&b, "    %s;\n", bindingSignature(member))
+		}
+	}
+	for _, member := range class.Bindings {
+		if member.Kind == "method" {
+			fmt.Fprintf(&b, "    %s;\n", methodSignature(member))
+		}
+	}
+	b.WriteString("}")
+
+	return fmt.Sprintf("### Class %s\n\n%s", class.Class.Name.Value, s.declarationMarkdown(decl, b.String(), docPath))
+}
+
+// bindingHover describes a variable, parameter, function or member.
+func (s *Server) bindingHover(b *Binding, docPath string) string {
+	signature := bindingSignature(b)
+	if b.Kind == "method" {
+		signature = methodSignature(b)
+	}
+	return s.declarationMarkdown(b, signature, docPath)
+}
+
+// methodSignature renders a method including the get, set or op marker that
+// bindingSignature leaves out.
+func methodSignature(b *Binding) string {
+	fd := b.Node.(*FunctionDefinition)
+	var prefix string
+	if fd.Private {
+		prefix += "private "
+	}
+	if fd.Static {
+		prefix += "static "
+	}
+	name := b.Name
+	switch {
+	case fd.Name.Op:
+		name = "op " + fd.Name.String
+	case fd.Name.Get:
+		name = "get " + name
+	case fd.Name.Set:
+		name = "set " + name
+	}
+
+	signature := prefix + "func " + name + "(" + formatParameters(fd.Parameters) + ")"
+	if fd.ReturnType.Value != "" {
+		signature += ": " + fd.ReturnType.Value
+	}
+	return signature
+}
+
+// innermostStatement returns the deepest statement whose tokens cover offset.
+func innermostStatement(stmts []*Statement, offset int) *Statement {
+	var found *Statement
+	forEachStatement(stmts, func(stmt *Statement) {
+		if len(stmt.Tokens) > 0 && stmt.Tokens[0].Pos.Offset <= offset && offset <= tokensEnd(stmt.Tokens) {
+			found = stmt
+		}
+	})
+	return found
+}
+
+// innermostFactor returns the deepest factor of stmt whose tokens cover
+// offset, or nil when offset is not inside an expression.
+func innermostFactor(stmt *Statement, offset int) *Factor {
+	var found *Factor
+	forEachFactorInStatement(stmt, func(fact *Factor) {
+		if len(fact.Tokens) > 0 && fact.Tokens[0].Pos.Offset <= offset && offset <= tokensEnd(fact.Tokens) {
+			found = fact
+		}
+	})
+	return found
+}
+
+func tokenEnd(t lexer.Token) int {
+	return t.Pos.Offset + len(t.Value)
+}
+
+func isIdentToken(t lexer.Token) bool {
+	return t.Value != "" && (t.Value[0] == '_' || unicode.IsLetter(rune(t.Value[0])))
+}
+
+// tokenAt returns the index of the token under offset. A cursor just past a
+// name still counts as being on it.
+func tokenAt(tokens []lexer.Token, offset int) int {
+	for i, t := range tokens {
+		if t.Pos.Offset <= offset && offset < tokenEnd(t) {
+			return i
+		}
+	}
+	for i, t := range tokens {
+		if tokenEnd(t) == offset && isIdentToken(t) {
+			return i
+		}
+	}
+	return -1
+}
+
+// chainSegment returns the names of the member chain that tokens start with,
+// as in `*p.next[i].value`, and which of them token i is. Tokens inside GEP
+// indices and call arguments are not part of the chain.
+func chainSegment(tokens []lexer.Token, i int) (chain []string, segment int) {
+	segment, depth := -1, 0
+	for j, t := range tokens {
+		switch {
+		case t.Value == "[":
+			depth++
+		case t.Value == "]":
+			depth--
+		case depth > 0:
+		case t.Value == "(" || t.Value == "=":
+			return chain, segment
+		case isIdentToken(t):
+			if j == i {
+				segment = len(chain)
+			}
+			chain = append(chain, t.Value)
+		}
+	}
+	return chain, segment
+}
+
+// hoverAt describes the symbol, type, literal or import under the cursor. The
+// token is located in the AST and resolved through the scope model, so
+// shadowed names and member accesses resolve to the right declaration.
+func (s *Server) hoverAt(uri lsp.DocumentURI, pos lsp.Position) *MdHover {
+	doc := s.documents[string(uri)]
+	prog := s.asts[string(uri)]
+	if prog == nil {
+		return nil
+	}
+	docPath := uriToPath(uri)
+	offset := s.astOffset(uri, positionToOffset(doc, pos))
+	sc := BuildScopes(prog)
+
+	stmt := innermostStatement(prog.Statements, offset)
+	if stmt == nil {
+		return nil
+	}
+	tokens := stmt.Tokens
+	fact := innermostFactor(stmt, offset)
+	if fact != nil {
+		tokens = fact.Tokens
+	}
+	i := tokenAt(tokens, offset)
+	if i < 0 {
+		return nil
+	}
+	start, end := tokens[i].Pos.Offset, tokenEnd(tokens[i])
+
+	var value string
+	switch {
+	case fact != nil && fact.Value != nil:
+		start, end = fact.Tokens[0].Pos.Offset, tokensEnd(fact.Tokens)
+		if fact.Value.String == nil {
+			value = numberHover(strings.TrimLeft(s.parsed[string(uri)][start:end], "- "))
+		}
+	case strings.HasPrefix(tokens[i].Value, "\""):
+		if pkg := importedPackage(stmt); pkg != "" {
+			value = importHover(uri, pkg)
+		} else if stmt.External != nil {
+			value = s.nameHover(docPath, prog, sc, strings.Trim(tokens[i].Value, "\""), offset)
+		}
+	case isIdentToken(tokens[i]):
+		value = s.identHover(docPath, prog, sc, stmt, fact, tokens, i, offset)
+	}
+	if value == "" {
+		return nil
+	}
+
+	return &MdHover{
+		Contents: MarkupContent{Kind: "markdown", Value: value},
+		Range: &Range{
+			Start: toPosition(offsetToPosition(doc, s.docOffset(uri, start))),
+			End:   toPosition(offsetToPosition(doc, s.docOffset(uri, end))),
+		},
+	}
+}
+
+func toPosition(p lsp.Position) Position {
+	return Position{Line: p.Line, Character: p.Character}
+}
+
+// identHover describes the name token i of tokens, which belong to fact or,
+// outside expressions, to stmt.
+func (s *Server) identHover(docPath string, prog *Program, sc *Scope, stmt *Statement, fact *Factor, tokens []lexer.Token, i, offset int) string {
+	name := tokens[i].Value
+
+	// Types follow a `:` or `new`, possibly behind pointer stars.
+	j := i - 1
+	for j >= 0 && tokens[j].Value == "*" {
+		j--
+	}
+	if j >= 0 && (tokens[j].Value == ":" || tokens[j].Value == "new") {
+		if isBuiltinType(name) {
+			return fmt.Sprintf("```cffc\n%s\n```\n\nBuiltin type", name)
+		}
+		if class := s.classScope(docPath, prog, sc, name); class != nil {
+			return s.classHover(class, docPath)
+		}
+		return ""
+	}
+
+	if fact != nil {
+		switch {
+		case fact.Identifier != nil, fact.ClassMethod != nil:
+			return s.chainHover(docPath, prog, sc, tokens, i, offset)
+		case fact.FunctionCall != nil:
+			return s.nameHover(docPath, prog, sc, name, offset)
+		}
+		return ""
+	}
+
+	switch {
+	case stmt.Assignment != nil:
+		return s.chainHover(docPath, prog, sc, tokens, i, offset)
+	case stmt.FromImport != nil, stmt.FromImportMultiple != nil:
+		return s.importedSymbolHover(docPath, stmt, name)
+	case stmt.FunctionDefinition != nil:
+		fd := stmt.FunctionDefinition
+		for _, p := range fd.Parameters {
+			if p.Pos.Offset == tokens[i].Pos.Offset {
+				if spans := braceSpans(stmt.Tokens); len(spans) > 0 {
+					return s.nameHover(docPath, prog, sc, name, spans[0][0]+1)
+				}
+			}
+		}
+	case stmt.External != nil:
+		for _, p := range stmt.External.Parameters {
+			if p.Pos.Offset == tokens[i].Pos.Offset {
+				return s.bindingHover(&Binding{Name: name, Kind: "parameter", Type: p.Type.Value, Pos: p.Pos, Node: p, Scope: sc}, docPath)
+			}
+		}
+	}
+	return s.nameHover(docPath, prog, sc, name, offset)
+}
+
+// chainHover describes one segment of a member chain: the receiver itself or
+// the member of the class the preceding segments resolve to.
+func (s *Server) chainHover(docPath string, prog *Program, sc *Scope, tokens []lexer.Token, i, offset int) string {
+	chain, segment := chainSegment(tokens, i)
+	switch {
+	case segment < 0:
+		return ""
+	case segment == 0:
+		return s.nameHover(docPath, prog, sc, chain[0], offset)
+	}
+
+	class, _ := s.receiverClass(docPath, prog, sc, offset, chain[:segment])
+	if class == nil {
+		return ""
+	}
+	if member := class.Member(chain[segment]); member != nil {
+		return s.bindingHover(member, docPath)
+	}
+	return ""
+}
+
+// nameHover resolves a plain name as seen from offset, falling back to the
+// symbols brought in by imports.
+func (s *Server) nameHover(docPath string, prog *Program, sc *Scope, name string, offset int) string {
+	if name == "this" {
+		if cd := sc.EnclosingClass(offset); cd != nil {
+			if class := s.classScope(docPath, prog, sc, cd.Name.Value); class != nil {
+				return s.classHover(class, docPath)
+			}
+		}
+		return ""
+	}
+
+	b := sc.Lookup(name, offset)
+	if b == nil {
+		for _, sym := range s.importedSymbols(docPath, prog) {
+			if sym.Name != name {
+				continue
+			}
+			if imported, err := s.scopesOf(sym.Data["file"]); err == nil {
+				b = imported.Lookup(sym.Data["symbol"], 0)
+			}
+		}
+	}
+	if b == nil {
+		return ""
+	}
+	if b.Kind == "class" {
+		if class := b.Scope.root().ClassScope(b.Name); class != nil {
+			return s.classHover(class, docPath)
+		}
+	}
+	return s.bindingHover(b, docPath)
+}
+
+// importedSymbolHover describes a symbol or alias listed in a from-import.
+func (s *Server) importedSymbolHover(docPath string, stmt *Statement, name string) string {
+	symbol := name
+	switch {
+	case stmt.FromImport != nil:
+		if name == stmt.FromImport.Alias {
+			symbol = stmt.FromImport.Symbol
+		}
+	case stmt.FromImportMultiple != nil:
+		for _, sym := range stmt.FromImportMultiple.Symbols {
+			if name == sym.Alias {
+				symbol = sym.Name
+			}
+		}
+	}
+
+	file, err := resolveImportFile(importedPackage(stmt), filepath.Dir(docPath), cache)
+	if err != nil {
+		return ""
+	}
+	imported, err := s.scopesOf(file)
+	if err != nil {
+		return ""
+	}
+	b := imported.Lookup(symbol, 0)
+	if b == nil || !b.Exported {
+		return ""
+	}
+	if b.Kind == "class" {
+		if class := imported.ClassScope(b.Name); class != nil {
+			return s.classHover(class, docPath)
+		}
+	}
+	return s.bindingHover(b, docPath)
+}
@@ -0,0 +1,858 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/alecthomas/participle/v2/lexer"
+	"github.com/vyPal/go-lsp"
+)
+
+type moduleInfo struct {
+	modTime time.Time
+	ast     *Program
+}
+
+func uriToPath(uri lsp.DocumentURI) string {
+	u, err := url.Parse(string(uri))
+	if err != nil {
+		return ""
+	}
+	return u.Path
+}
+
+func pathToURI(path string) lsp.DocumentURI {
+	return lsp.DocumentURI((&url.URL{Scheme: "file", Path: filepath.ToSlash(path)}).String())
+}
+
+// importedPackage returns the unquoted import string of an import statement,
+// or "" if the statement is not an import.
+func importedPackage(stmt *Statement) string {
+	switch {
+	case stmt.Import != nil:
+		return strings.Trim(stmt.Import.Package, "\"")
+	case stmt.FromImport != nil:
+		return strings.Trim(stmt.FromImport.Package, "\"")
+	case stmt.FromImportMultiple != nil:
+		return strings.Trim(stmt.FromImportMultiple.Package, "\"")
+	}
+	return ""
+}
+
+// resolveImportFile resolves an import string written in a file inside dir to
+// the .cffc file it refers to.
+func resolveImportFile(pkg, dir string, pcache PackageCache) (string, error) {
+	importPath, err := ResolveImportPath(pkg, pcache)
+	if err != nil {
+		return "", err
+	}
+
+	if !filepath.IsAbs(importPath) {
+		importPath = filepath.Join(dir, importPath)
+	}
+
+	if !strings.HasSuffix(importPath, ".cffc") {
+		importPath += ".cffc"
+	}
+
+	return importPath, nil
+}
+
+// ImportPathFor is the reverse of ResolveImportPath: it returns the shortest
+// import string that, written in a file inside fromDir, resolves to target.
+// Every candidate is checked against ResolveImportPath, so a package path is
+// only offered when the package cache really maps it back to target.
+func ImportPathFor(target, fromDir string, pcache PackageCache) (string, bool) {
+	return importPathFor(target, fromDir, pcache, packageSourceDirs(pcache))
+}
+
+// packageSourceDirs maps the path of every cached package to the directory
+// holding its sources, reading each cfconf.yaml once.
+func packageSourceDirs(pcache PackageCache) map[string]string {
+	dirs := make(map[string]string)
+	for _, pkg := range pcache.PkgList {
+		conf, err := GetCfConf(pkg.Path)
+		if err != nil {
+			continue
+		}
+		if conf.SourceDir == "" {
+			conf.SourceDir = "src"
+		}
+		dirs[pkg.Path] = filepath.Join(pkg.Path, conf.SourceDir)
+	}
+	return dirs
+}
+
+// importPathFor is ImportPathFor with the source directories of the cached
+// packages already looked up.
+func importPathFor(target, fromDir string, pcache PackageCache, dirs map[string]string) (string, bool) {
+	target = filepath.Clean(target)
+	candidates := []string{}
+
+	if rel, err := filepath.Rel(fromDir, target); err == nil {
+		rel = filepath.ToSlash(strings.TrimSuffix(rel, ".cffc"))
+		if !strings.HasPrefix(rel, "../") {
+			rel = "./" + rel
+		}
+		candidates = append(candidates, rel)
+	}
+
+	for _, pkg := range pcache.PkgList {
+		dir, ok := dirs[pkg.Path]
+		if !ok {
+			continue
+		}
+
+		rel, err := filepath.Rel(dir, target)
+		if err != nil || strings.HasPrefix(rel, "..") {
+			continue
+		}
+		rel = filepath.ToSlash(strings.TrimSuffix(rel, ".cffc"))
+
+		candidates = append(candidates, pkg.Identifier+"/"+rel)
+		if strings.HasPrefix(pkg.Identifier, "github.com/") {
+			candidates = append(candidates, strings.TrimPrefix(pkg.Identifier, "github.com/")+"/"+rel)
+		}
+	}
+
+	sort.SliceStable(candidates, func(i, j int) bool {
+		return len(candidates[i]) < len(candidates[j])
+	})
+
+	for _, c := range candidates {
+		resolved, err := resolveImportFile(c, fromDir, pcache)
+		if err == nil && filepath.Clean(resolved) == target {
+			return c, true
+		}
+	}
+
+	return "", false
+}
+
+// loadModule returns the AST of the .cffc file at path. Open documents are
+// served from memory, other files are parsed from disk and kept until their
+// modification time changes.
+func (s *Server) loadModule(path string) (*Program, error) {
+	if a, ok := s.asts[string(pathToURI(path))]; ok {
+		return a, nil
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+
+	if m, ok := s.modules[path]; ok && m.modTime.Equal(info.ModTime()) {
+		return m.ast, nil
+	}
+
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var a *Program
+	if e := TryCatch(func() {
+		a, err = parseProgram(string(content))
+	})(); e != nil {
+		return nil, e
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	s.modules[path] = &moduleInfo{modTime: info.ModTime(), ast: a}
+	return a, nil
+}
+
+// moduleFiles lists the .cffc files of the workspace and of every cached
+// package's source directory. The list is walked once and kept until files
+// change on disk or a module missing from it is opened.
+func (s *Server) moduleFiles() []string {
+	if s.files == nil {
+		s.files = s.walkModuleFiles()
+	}
+	return s.files
+}
+
+// noteModule drops the cached file list when path is a workspace module the
+// list does not contain yet.
+func (s *Server) noteModule(path string) {
+	if s.files == nil || !strings.HasSuffix(path, ".cffc") || s.root == "" || !strings.HasPrefix(path, s.root) {
+		return
+	}
+	for _, file := range s.files {
+		if filepath.Clean(file) == filepath.Clean(path) {
+			return
+		}
+	}
+	s.files = nil
+}
+
+// DidChangeWatchedFiles forgets the cached file list when .cffc files are
+// created or deleted.
+func (s *Server) DidChangeWatchedFiles(ctx context.Context, params lsp.DidChangeWatchedFilesParams) error {
+	for _, change := range params.Changes {
+		kind := lsp.FileChangeType(change.Type)
+		if (kind == lsp.Created || kind == lsp.Deleted) && strings.HasSuffix(string(change.URI), ".cffc") {
+			s.files = nil
+		}
+	}
+	return nil
+}
+
+// walkModuleFiles searches the disk for the files moduleFiles lists.
+func (s *Server) walkModuleFiles() []string {
+	files := []string{}
+
+	walk := func(root string) {
+		filepath.WalkDir(root, func(path string, d os.DirEntry, err error) error {
+			if err != nil {
+				return nil
+			}
+			if d.IsDir() {
+				if path != root && (strings.HasPrefix(d.Name(), ".") || d.Name() == "node_modules") {
+					return filepath.SkipDir
+				}
+				return nil
+			}
+			if strings.HasSuffix(path, ".cffc") {
+				files = append(files, path)
+			}
+			return nil
+		})
+	}
+
+	if s.root != "" {
+		walk(s.root)
+	}
+
+	for _, pkg := range cache.PkgList {
+		conf, err := GetCfConf(pkg.Path)
+		if err != nil {
+			continue
+		}
+		if conf.SourceDir == "" {
+			conf.SourceDir = "src"
+		}
+		walk(filepath.Join(pkg.Path, conf.SourceDir))
+	}
+
+	return files
+}
+
+func formatParameters(params []*ArgumentDefinition) string {
+	var s []string
+	for _, p := range params {
+		s = append(s, p.Name.Value+": "+p.Type.Value)
+	}
+	return strings.Join(s, ", ")
+}
+
+// exportedSymbols lists the symbols that a module defined in file makes
+// available to the files importing it.
+func exportedSymbols(prog *Program, file string) []CTSymbol {
+	symbols := []CTSymbol{}
+
+	for _, stmt := range prog.Statements {
+		if stmt.Export == nil {
+			continue
+		}
+		exp := stmt.Export
+
+		if exp.FunctionDefinition != nil {
+			fd := exp.FunctionDefinition
+			symbols = append(symbols, CTSymbol{
+				Name: fd.Name.Name.Value,
+				Type: "function",
+				Data: map[string]string{
+					"file":       file,
+					"location":   fmt.Sprintf("%s#L%d", file, stmt.Pos.Line),
+					"definition": "func " + fd.Name.Name.Value + "(" + formatParameters(fd.Parameters) + "): " + fd.ReturnType.Value,
+				},
+			})
+		} else if exp.External != nil {
+			ext := exp.External
+			symbols = append(symbols, CTSymbol{
+				Name: ext.Name.Value,
+				Type: "function",
+				Data: map[string]string{
+					"file":       file,
+					"location":   fmt.Sprintf("%s#L%d", file, stmt.Pos.Line),
+					"definition": "extern func " + ext.Name.Value + "(" + formatParameters(ext.Parameters) + "): " + ext.ReturnType.Value,
+				},
+			})
+		} else if exp.ClassDefinition != nil {
+			symbols = append(symbols, CTSymbol{
+				Name: exp.ClassDefinition.Name.Value,
+				Type: "class",
+				Data: map[string]string{
+					"file":       file,
+					"location":   fmt.Sprintf("%s#L%d", file, stmt.Pos.Line),
+					"definition": "class " + exp.ClassDefinition.Name.Value,
+				},
+			})
+		}
+	}
+
+	return symbols
+}
+
+// visibleNames collects the top-level names a document can already use: its
+// own declarations and everything its imports bring into scope.
+func (s *Server) visibleNames(docPath string, prog *Program) map[string]bool {
+	names := make(map[string]bool)
+
+	for _, stmt := range prog.Statements {
+		decl := stmt
+		if decl.Export != nil {
+			decl = decl.Export
+		}
+
+		switch {
+		case decl.FunctionDefinition != nil:
+			names[decl.FunctionDefinition.Name.Name.Value] = true
+		case decl.External != nil:
+			names[strings.Trim(decl.External.Name.Value, "\"")] = true
+		case decl.ClassDefinition != nil:
+			names[decl.ClassDefinition.Name.Value] = true
+		case decl.VariableDefinition != nil:
+			names[decl.VariableDefinition.Name.Value] = true
+		case decl.FromImport != nil:
+			if decl.FromImport.Alias != "" {
+				names[decl.FromImport.Alias] = true
+			} else {
+				names[decl.FromImport.Symbol] = true
+			}
+		case decl.FromImportMultiple != nil:
+			for _, sym := range decl.FromImportMultiple.Symbols {
+				if sym.Alias != "" {
+					names[sym.Alias] = true
+				} else {
+					names[sym.Name] = true
+				}
+			}
+		case decl.Import != nil:
+			file, err := resolveImportFile(importedPackage(decl), filepath.Dir(docPath), cache)
+			if err != nil {
+				continue
+			}
+			imported, err := s.loadModule(file)
+			if err != nil {
+				continue
+			}
+			for _, sym := range exportedSymbols(imported, file) {
+				names[sym.Name] = true
+			}
+		}
+	}
+
+	return names
+}
+
+// importedSymbols lists the exports a document's imports bring into scope,
+// named as the document refers to them. Data["symbol"] keeps the exported
+// name of aliased from-imports.
+func (s *Server) importedSymbols(docPath string, prog *Program) []CTSymbol {
+	symbols := []CTSymbol{}
+
+	for _, stmt := range prog.Statements {
+		if stmt.Import == nil && stmt.FromImport == nil && stmt.FromImportMultiple == nil {
+			continue
+		}
+		file, err := resolveImportFile(importedPackage(stmt), filepath.Dir(docPath), cache)
+		if err != nil {
+			continue
+		}
+		imported, err := s.loadModule(file)
+		if err != nil {
+			continue
+		}
+
+		for _, sym := range exportedSymbols(imported, file) {
+			sym.Data["symbol"] = sym.Name
+			switch {
+			case stmt.Import != nil:
+				symbols = append(symbols, sym)
+			case stmt.FromImport != nil:
+				if stmt.FromImport.Symbol == sym.Name {
+					if stmt.FromImport.Alias != "" {
+						sym.Name = stmt.FromImport.Alias
+					}
+					symbols = append(symbols, sym)
+				}
+			case stmt.FromImportMultiple != nil:
+				for _, imp := range stmt.FromImportMultiple.Symbols {
+					if imp.Name == sym.Name {
+						alias := sym
+						if imp.Alias != "" {
+							alias.Name = imp.Alias
+						}
+						symbols = append(symbols, alias)
+					}
+				}
+			}
+		}
+	}
+
+	return symbols
+}
+
+// findExports looks up exported symbols with the given name in every module
+// known to the server except the document itself. An empty name matches
+// every export.
+func (s *Server) findExports(name, docPath string) []CTSymbol {
+	found := []CTSymbol{}
+
+	for _, file := range s.moduleFiles() {
+		if filepath.Clean(file) == filepath.Clean(docPath) {
+			continue
+		}
+		prog, err := s.loadModule(file)
+		if err != nil {
+			continue
+		}
+		for _, sym := range exportedSymbols(prog, file) {
+			if name == "" || sym.Name == name {
+				found = append(found, sym)
+			}
+		}
+	}
+
+	return found
+}
+
+// importStatementEnd returns the offset just past the terminating ';' of an
+// import statement starting at pos.
+func importStatementEnd(doc string, pos lexer.Position) int {
+	end := strings.IndexByte(doc[pos.Offset:], ';')
+	if end < 0 {
+		return len(doc)
+	}
+	return pos.Offset + end + 1
+}
+
+func formatFromImport(pkg string, symbols []Symbol) string {
+	var parts []string
+	for _, sym := range symbols {
+		if sym.Alias != "" {
+			parts = append(parts, sym.Name+" as "+sym.Alias)
+		} else {
+			parts = append(parts, sym.Name)
+		}
+	}
+	return fmt.Sprintf("from \"%s\" import { %s };", pkg, strings.Join(parts, ", "))
+}
+
+// importEdit returns the edit that makes name from importPath visible in doc.
+// An existing from-import of the same package is extended in place, anything
+// else gets a plain import statement after the last import.
+func importEdit(doc string, prog *Program, name, importPath string) lsp.TextEdit {
+	insertAt := -1
+
+	for _, stmt := range prog.Statements {
+		pkg := importedPackage(stmt)
+		if pkg == "" {
+			continue
+		}
+		end := importStatementEnd(doc, stmt.Pos)
+		insertAt = end
+
+		if pkg != importPath {
+			continue
+		}
+
+		var symbols []Symbol
+		if stmt.FromImportMultiple != nil {
+			symbols = append(symbols, stmt.FromImportMultiple.Symbols...)
+		} else if stmt.FromImport != nil {
+			symbols = append(symbols, Symbol{Name: stmt.FromImport.Symbol, Alias: stmt.FromImport.Alias})
+		} else {
+			continue
+		}
+
+		return lsp.TextEdit{
+			Range:   offsetRange(doc, stmt.Pos.Offset, end),
+			NewText: formatFromImport(importPath, append(symbols, Symbol{Name: name})),
+		}
+	}
+
+	newText := "\nimport \"" + importPath + "\";"
+	if insertAt < 0 {
+		// No imports yet, place the first one below the package clause.
+		insertAt = strings.IndexByte(doc[prog.Pos.Offset:], ';') + prog.Pos.Offset + 1
+		newText = "\n" + newText
+	}
+
+	return lsp.TextEdit{Range: offsetRange(doc, insertAt, insertAt), NewText: newText}
+}
+
+// importPaths memoizes the import strings of modules for a document while a
+// request runs, as the symbols of a module share one.
+type importPaths struct {
+	fromDir string
+	dirs    map[string]string
+	paths   map[string]string
+}
+
+func newImportPaths(docPath string) *importPaths {
+	return &importPaths{fromDir: filepath.Dir(docPath), dirs: packageSourceDirs(cache), paths: make(map[string]string)}
+}
+
+// of returns the import string for the module at file, or "" when the
+// document cannot import it.
+func (p *importPaths) of(file string) string {
+	if path, ok := p.paths[file]; ok {
+		return path
+	}
+	path, _ := importPathFor(file, p.fromDir, cache, p.dirs)
+	p.paths[file] = path
+	return path
+}
+
+// liveImportEdit returns importEdit for the parsed text of the document at uri
+// moved onto its current text. It reports false when the place the edit goes
+// has been edited since the parse.
+func (s *Server) liveImportEdit(uri lsp.DocumentURI, prog *Program, name, importPath string) (lsp.TextEdit, bool) {
+	edits, ok := s.liveEdits(uri, []lsp.TextEdit{importEdit(s.parsed[string(uri)], prog, name, importPath)})
+	if !ok {
+		return lsp.TextEdit{}, false
+	}
+	return edits[0], true
+}
+
+// autoImportActions offers quick fixes that import functions and classes used
+// in rng but not declared or imported by the document.
+func (s *Server) autoImportActions(uri lsp.DocumentURI, doc string, prog *Program, rng lsp.Range) []CodeAction {
+	docPath := uriToPath(uri)
+	visible := s.visibleNames(docPath, prog)
+	paths := newImportPaths(docPath)
+	seen := make(map[string]bool)
+	actions := []CodeAction{}
+
+	forEachFactor(prog.Statements, func(fact *Factor) {
+		var name string
+		var pos lexer.Position
+		if fact.FunctionCall != nil && !strings.HasPrefix(fact.FunctionCall.FunctionName, "\"") {
+			name, pos = fact.FunctionCall.FunctionName, fact.FunctionCall.Pos
+		} else if fact.ClassInitializer != nil {
+			name, pos = fact.ClassInitializer.ClassName.Value, fact.ClassInitializer.Pos
+		} else {
+			return
+		}
+
+		if visible[name] || seen[name] {
+			return
+		}
+
+		if !rangesOverlap(offsetRange(doc, pos.Offset, pos.Offset+len(name)), rng) {
+			return
+		}
+		seen[name] = true
+
+		for _, sym := range s.findExports(name, docPath) {
+			importPath := paths.of(sym.Data["file"])
+			if importPath == "" {
+				continue
+			}
+			actions = append(actions, CodeAction{
+				Title: fmt.Sprintf("Import '%s' from \"%s\"", name, importPath),
+				Kind:  lsp.CAKQuickFix,
+				Edit:  singleEdit(uri, importEdit(doc, prog, name, importPath)),
+			})
+		}
+	})
+
+	if len(actions) == 1 {
+		actions[0].IsPreferred = true
+	}
+
+	return actions
+}
+
+// autoImportCompletions offers exported symbols from other modules that start
+// with word, each carrying the import edit that makes it usable.
+func (s *Server) autoImportCompletions(uri lsp.DocumentURI, prog *Program, word string) []CompletionItem {
+	items := []CompletionItem{}
+	if word == "" || prog == nil {
+		return items
+	}
+
+	docPath := uriToPath(uri)
+	visible := s.visibleNames(docPath, prog)
+	paths := newImportPaths(docPath)
+
+	for _, sym := range s.findExports("", docPath) {
+		if _, ok := fuzzyScore(word, sym.Name); visible[sym.Name] || !ok {
+			continue
+		}
+		importPath := paths.of(sym.Data["file"])
+		if importPath == "" {
+			continue
+		}
+		edit, ok := s.liveImportEdit(uri, prog, sym.Name, importPath)
+		if !ok {
+			continue
+		}
+
+		kind := lsp.CIKFunction
+		if sym.Type == "class" {
+			kind = lsp.CIKClass
+		}
+
+		items = append(items, CompletionItem{
+			CompletionItem: lsp.CompletionItem{
+				Label:  sym.Name,
+				Kind:   kind,
+				Detail: fmt.Sprintf("(import \"%s\")", importPath),
+			},
+			AdditionalTextEdits: []lsp.TextEdit{edit},
+			Data:                &completionData{URI: uri, File: sym.Data["file"], Name: sym.Name, Import: importPath},
+		})
+	}
+
+	return items
+}
+
+// importSpec is one import after organizing: either a whole module import or
+// the symbols taken from a package with a from-import.
+type importSpec struct {
+	pkg     string
+	whole   bool
+	symbols []Symbol
+	cached  bool // pkg names a package from the cache
+}
+
+func (spec importSpec) String() string {
+	if spec.whole {
+		return "import \"" + spec.pkg + "\";"
+	}
+	if len(spec.symbols) == 1 {
+		line := fmt.Sprintf("from \"%s\" import %s", spec.pkg, spec.symbols[0].Name)
+		if spec.symbols[0].Alias != "" {
+			line += " as " + spec.symbols[0].Alias
+		}
+		return line + ";"
+	}
+	return formatFromImport(spec.pkg, spec.symbols)
+}
+
+// referencedNames collects every name a program uses outside of declarations:
+// called functions, instantiated classes, identifiers, casts and the class
+// names in type annotations.
+func referencedNames(prog *Program) map[string]bool {
+	names := make(map[string]bool)
+	addType := func(t string) {
+		if t != "" {
+			names[strings.TrimLeft(t, "*")] = true
+		}
+	}
+
+	forEachFactor(prog.Statements, func(fact *Factor) {
+		switch {
+		case fact.FunctionCall != nil:
+			names[strings.Trim(fact.FunctionCall.FunctionName, "\"")] = true
+		case fact.ClassInitializer != nil:
+			names[fact.ClassInitializer.ClassName.Value] = true
+		case fact.ClassMethod != nil:
+			names[fact.ClassMethod.Identifier.Name] = true
+		case fact.Identifier != nil:
+			names[fact.Identifier.Name] = true
+		case fact.BitCast != nil:
+			addType(fact.BitCast.Type)
+		}
+	})
+
+	forEachStatement(prog.Statements, func(stmt *Statement) {
+		switch {
+		case stmt.VariableDefinition != nil:
+			addType(stmt.VariableDefinition.Type.Value)
+		case stmt.FieldDefinition != nil:
+			addType(stmt.FieldDefinition.Type.Value)
+		case stmt.Assignment != nil:
+			names[stmt.Assignment.Left.Name] = true
+		case stmt.FunctionDefinition != nil:
+			for _, p := range stmt.FunctionDefinition.Parameters {
+				addType(p.Type.Value)
+			}
+			addType(stmt.FunctionDefinition.ReturnType.Value)
+		case stmt.External != nil:
+			for _, p := range stmt.External.Parameters {
+				addType(p.Type.Value)
+			}
+			addType(stmt.External.ReturnType.Value)
+		}
+	})
+
+	return names
+}
+
+// isPackageImport reports whether an import string names a package from the
+// cache rather than a file relative to the importing document.
+func isPackageImport(pkg string) bool {
+	if strings.HasPrefix(pkg, "./") || strings.HasPrefix(pkg, "../") || strings.HasPrefix(pkg, "/") {
+		return false
+	}
+	found, _, _, err := cache.ResolvePackage(pkg)
+	return err == nil && found
+}
+
+// moduleUsed reports whether any export of the module behind a whole-module
+// import is referenced. Modules that cannot be loaded count as used so that
+// organizing never drops an import it does not understand.
+func (s *Server) moduleUsed(pkg, docPath string, used map[string]bool) bool {
+	file, err := resolveImportFile(pkg, filepath.Dir(docPath), cache)
+	if err != nil {
+		return true
+	}
+	prog, err := s.loadModule(file)
+	if err != nil {
+		return true
+	}
+
+	exports := exportedSymbols(prog, file)
+	if len(exports) == 0 {
+		return true
+	}
+	for _, sym := range exports {
+		if used[sym.Name] {
+			return true
+		}
+	}
+	return false
+}
+
+// organizedImports merges, filters, deduplicates and sorts the imports of a
+// program. Package imports come first, followed by relative imports.
+func (s *Server) organizedImports(docPath string, prog *Program) []importSpec {
+	used := referencedNames(prog)
+	whole := make(map[string]bool)
+	symbols := make(map[string][]Symbol)
+
+	addSymbol := func(pkg string, sym Symbol) {
+		name := sym.Name
+		if sym.Alias != "" {
+			name = sym.Alias
+		}
+		if !used[name] {
+			return
+		}
+		for _, existing := range symbols[pkg] {
+			if existing.Name == sym.Name && existing.Alias == sym.Alias {
+				return
+			}
+		}
+		symbols[pkg] = append(symbols[pkg], sym)
+	}
+
+	for _, stmt := range prog.Statements {
+		pkg := importedPackage(stmt)
+		switch {
+		case stmt.Import != nil:
+			if s.moduleUsed(pkg, docPath, used) {
+				whole[pkg] = true
+			}
+		case stmt.FromImport != nil:
+			addSymbol(pkg, Symbol{Name: stmt.FromImport.Symbol, Alias: stmt.FromImport.Alias})
+		case stmt.FromImportMultiple != nil:
+			for _, sym := range stmt.FromImportMultiple.Symbols {
+				addSymbol(pkg, sym)
+			}
+		}
+	}
+
+	specs := []importSpec{}
+	for pkg := range whole {
+		specs = append(specs, importSpec{pkg: pkg, whole: true})
+	}
+	for pkg, syms := range symbols {
+		sort.SliceStable(syms, func(i, j int) bool { return syms[i].Name < syms[j].Name })
+		specs = append(specs, importSpec{pkg: pkg, symbols: syms})
+	}
+
+	for i := range specs {
+		specs[i].cached = isPackageImport(specs[i].pkg)
+	}
+	sort.Slice(specs, func(i, j int) bool {
+		if specs[i].cached != specs[j].cached {
+			return specs[i].cached
+		}
+		if specs[i].pkg != specs[j].pkg {
+			return specs[i].pkg < specs[j].pkg
+		}
+		return specs[i].whole
+	})
+
+	return specs
+}
+
+// organizeImportsAction rewrites the imports of a document as returned by
+// organizedImports. It returns nil when the imports are already organized.
+func (s *Server) organizeImportsAction(uri lsp.DocumentURI, doc string, prog *Program) *CodeAction {
+	var stmts []*Statement
+	for _, stmt := range prog.Statements {
+		if importedPackage(stmt) != "" {
+			stmts = append(stmts, stmt)
+		}
+	}
+	if len(stmts) == 0 {
+		return nil
+	}
+
+	specs := s.organizedImports(uriToPath(uri), prog)
+	var block strings.Builder
+	for i, spec := range specs {
+		if i > 0 {
+			if specs[i-1].cached != spec.cached {
+				block.WriteString("\n")
+			}
+			block.WriteString("\n")
+		}
+		block.WriteString(spec.String())
+	}
+
+	// Imports that only have whitespace between them are rewritten as one
+	// region, otherwise the block replaces the first import and the rest are
+	// deleted so that code and comments in between survive.
+	start := stmts[0].Pos.Offset
+	end := importStatementEnd(doc, stmts[len(stmts)-1].Pos)
+	contiguous := true
+	for i := 1; i < len(stmts); i++ {
+		if strings.TrimSpace(doc[importStatementEnd(doc, stmts[i-1].Pos):stmts[i].Pos.Offset]) != "" {
+			contiguous = false
+			break
+		}
+	}
+
+	var edits []lsp.TextEdit
+	if contiguous {
+		if doc[start:end] == block.String() {
+			return nil
+		}
+		if block.Len() == 0 {
+			end += len(doc[end:]) - len(strings.TrimLeft(doc[end:], " \t\r\n"))
+		}
+		edits = append(edits, lsp.TextEdit{Range: offsetRange(doc, start, end), NewText: block.String()})
+	} else {
+		edits = append(edits, lsp.TextEdit{
+			Range:   offsetRange(doc, start, importStatementEnd(doc, stmts[0].Pos)),
+			NewText: block.String(),
+		})
+		for _, stmt := range stmts[1:] {
+			from, to := lineRange(doc, stmt.Pos.Offset, importStatementEnd(doc, stmt.Pos))
+			edits = append(edits, lsp.TextEdit{Range: offsetRange(doc, from, to)})
+		}
+	}
+
+	return &CodeAction{
+		Title: "Organize imports",
+		Kind:  lsp.CAKSourceOrganizeImports,
+		Edit:  singleEdit(uri, edits...),
+	}
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/vyPal/go-lsp"
+)
+
+type InlayHintParams struct {
+	TextDocument lsp.TextDocumentIdentifier `json:"textDocument"`
+	Range        lsp.Range                  `json:"range"`
+}
+
+type InlayHint struct {
+	Position     lsp.Position `json:"position"`
+	Label        string       `json:"label"`
+	Kind         int          `json:"kind,omitempty"`
+	PaddingLeft  bool         `json:"paddingLeft,omitempty"`
+	PaddingRight bool         `json:"paddingRight,omitempty"`
+}
+
+const (
+	inlayHintType      = 1
+	inlayHintParameter = 2
+)
+
+// InlayHintSettings switches the kinds of inlay hints on and off. They are
+// read from the `cffc.inlayHints` section of the client configuration.
+type InlayHintSettings struct {
+	ParameterNames bool `json:"parameterNames"`
+	BitCastTypes   bool `json:"bitCastTypes"`
+	Durations      bool `json:"durations"`
+}
+
+var defaultInlayHints = InlayHintSettings{ParameterNames: true, BitCastTypes: true, Durations: true}
+
+type DidChangeConfigurationParams struct {
+	Settings json.RawMessage `json:"settings"`
+}
+
+// DidChangeConfiguration applies the client's settings and has the client
+// ask for hints again. Each kind that is missing from the settings or not a
+// boolean keeps its default.
+func (s *Server) DidChangeConfiguration(ctx context.Context, params DidChangeConfigurationParams) {
+	hints := defaultInlayHints
+	fields := settingsSection(params.Settings, "cffc", "inlayHints")
+	for name, field := range map[string]*bool{
+		"parameterNames": &hints.ParameterNames,
+		"bitCastTypes":   &hints.BitCastTypes,
+		"durations":      &hints.Durations,
+	} {
+		var value bool
+		if err := json.Unmarshal(fields[name], &value); err == nil {
+			*field = value
+		}
+	}
+	s.inlayHints = hints
+
+	// The handler runs on the connection's read loop, so the reply to the
+	// request cannot be waited for here.
+	if s.hintRefresh {
+		go s.conn.Call(context.Background(), "workspace/inlayHint/refresh", nil, nil)
+	}
+}
+
+// settingsSection follows path through nested settings objects and returns
+// the fields of the last one. Anything that is not an object on the way
+// yields no fields.
+func settingsSection(raw json.RawMessage, path ...string) map[string]json.RawMessage {
+	fields := map[string]json.RawMessage{}
+	if json.Unmarshal(raw, &fields) != nil {
+		return nil
+	}
+	for _, key := range path {
+		next := map[string]json.RawMessage{}
+		if json.Unmarshal(fields[key], &next) != nil {
+			return nil
+		}
+		fields = next
+	}
+	return fields
+}
+
+// InlayHint labels literal arguments with the name of their parameter, gives
+// casts and parenthesized expressions the type they resolve to and shows
+// duration literals in nanoseconds.
+func (s *Server) InlayHint(ctx context.Context, params InlayHintParams) ([]InlayHint, error) {
+	uri := params.TextDocument.URI
+	hints := []InlayHint{}
+	prog := s.asts[string(uri)]
+	if prog == nil {
+		return hints, nil
+	}
+	doc, parsed := s.documents[string(uri)], s.parsed[string(uri)]
+	from, to := positionToOffset(doc, params.Range.Start), positionToOffset(doc, params.Range.End)
+	file := uriToPath(uri)
+	sc := BuildScopes(prog)
+
+	// add places a hint at offset, which must lie in the unchanged text
+	// around the node spanning start to end.
+	add := func(start, end, offset int, hint InlayHint) {
+		docStart, docEnd := s.docOffset(uri, start), s.docOffset(uri, end)
+		if docEnd > len(doc) || end > len(parsed) || doc[docStart:docEnd] != parsed[start:end] {
+			return
+		}
+		at := s.docOffset(uri, offset)
+		if at < from || at > to {
+			return
+		}
+		hint.Position = offsetToPosition(doc, at)
+		hints = append(hints, hint)
+	}
+
+	forEachFactor(prog.Statements, func(fact *Factor) {
+		switch {
+		case fact.Value != nil && fact.Value.Duration != nil && s.inlayHints.Durations:
+			d := fact.Value.Duration
+			nanos := int64(d.Number * float64(durationUnitsInNanos[d.Unit]))
+			start, end := nodeOffsets(fact.Value)
+			add(start, end, end, InlayHint{Label: fmt.Sprintf("= %dns", nanos), PaddingLeft: true})
+		case fact.BitCast != nil && s.inlayHints.BitCastTypes:
+			t := sc.FactorType(fact, fact.Pos.Offset)
+			if fact.BitCast.Type != "" {
+				t = s.castTarget(file, prog, sc, fact.BitCast.Type)
+			}
+			if t != "" {
+				start, end := nodeOffsets(fact)
+				add(start, end, end, InlayHint{Label: ": " + t, Kind: inlayHintType})
+			}
+		case (fact.FunctionCall != nil || fact.ClassMethod != nil) && s.inlayHints.ParameterNames:
+			target, _, _ := s.callTarget(file, prog, sc, fact)
+			if target == nil {
+				return
+			}
+			var parameters []*ArgumentDefinition
+			switch node := target.Node.(type) {
+			case *FunctionDefinition:
+				parameters = node.Parameters
+			case *ExternalFunctionDefinition:
+				parameters = node.Parameters
+			}
+			var args []*Expression
+			if fact.FunctionCall != nil {
+				args = fact.FunctionCall.Args.Arguments
+			} else {
+				args = fact.ClassMethod.Args.Arguments
+			}
+			for i, arg := range args {
+				if i >= len(parameters) || !isLiteral(arg) || parameters[i].Name.Value == "" {
+					continue
+				}
+				start, end := nodeOffsets(arg)
+				add(start, end, start, InlayHint{Label: parameters[i].Name.Value + ":", Kind: inlayHintParameter, PaddingRight: true})
+			}
+		}
+	})
+	sort.SliceStable(hints, func(i, j int) bool {
+		return comparePositions(hints[i].Position, hints[j].Position) < 0
+	})
+	return hints, nil
+}
+
+// castTarget resolves the target type of a cast, following imported and
+// aliased class names to the class they name.
+func (s *Server) castTarget(file string, prog *Program, sc *Scope, typ string) string {
+	name := strings.TrimLeft(typ, "*")
+	if isBuiltinType(name) {
+		return typ
+	}
+	class := s.classScope(file, prog, sc, name)
+	if class == nil || class.Class == nil {
+		return ""
+	}
+	return typ[:len(typ)-len(name)] + class.Class.Name.Value
+}
+
+// isLiteral reports whether expr is a single literal value.
+func isLiteral(expr *Expression) bool {
+	return expr != nil && len(expr.Right) == 0 &&
+		expr.Left != nil && len(expr.Left.Right) == 0 &&
+		expr.Left.Left != nil && len(expr.Left.Left.Right) == 0 &&
+		expr.Left.Left.Left != nil && expr.Left.Left.Left.Value != nil
+}
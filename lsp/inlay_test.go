@@ -0,0 +1,88 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"testing"
+
+	"github.com/vyPal/go-lsp"
+)
+
+const inlaySource = `package main;
+
+func area(width: i32, height: i32): i32 {
+	return width * height;
+}
+
+func main(): void {
+	var a: i32 = area(2, 3);
+	var x: i64 = 3;
+	var y: i32 = (x):i32;
+	var z: i64 = (x);
+}
+`
+
+// inlayHints returns the hints of a range as "line:character label".
+func inlayHints(t *testing.T, s *Server, uri lsp.DocumentURI, rng lsp.Range) []string {
+	t.Helper()
+	hints, err := s.InlayHint(context.Background(), InlayHintParams{TextDocument: lsp.TextDocumentIdentifier{URI: uri}, Range: rng})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var labels []string
+	for _, h := range hints {
+		labels = append(labels, fmt.Sprintf("%d:%d %s", h.Position.Line, h.Position.Character, h.Label))
+	}
+	return labels
+}
+
+func TestInlayHintRange(t *testing.T) {
+	s, dir := newTestServer(t, map[string]string{"main.cffc": inlaySource})
+	uri := openDocument(t, s, dir, "main.cffc")
+
+	tests := []struct {
+		name string
+		rng  lsp.Range
+		want []string
+	}{
+		{"whole document", lspRange(0, 0, 12, 0), []string{"7:19 width:", "7:22 height:", "9:21 : i32", "10:17 : i64"}},
+		{"one line", lspRange(7, 0, 8, 0), []string{"7:19 width:", "7:22 height:"}},
+		{"part of a line", lspRange(7, 21, 7, 23), []string{"7:22 height:"}},
+		{"lines without hints", lspRange(0, 0, 6, 0), nil},
+	}
+	for _, tt := range tests {
+		if got := inlayHints(t, s, uri, tt.rng); fmt.Sprint(got) != fmt.Sprint(tt.want) {
+			t.Errorf("%s: got %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestInlayHintSettings(t *testing.T) {
+	s, dir := newTestServer(t, map[string]string{"main.cffc": inlaySource})
+	uri := openDocument(t, s, dir, "main.cffc")
+
+	tests := []struct {
+		settings string
+		want     InlayHintSettings
+	}{
+		{`{"cffc": {"inlayHints": {"parameterNames": false}}}`, InlayHintSettings{ParameterNames: false, BitCastTypes: true, Durations: true}},
+		// Malformed kinds keep their default, the others still apply.
+		{`{"cffc": {"inlayHints": {"parameterNames": "off", "bitCastTypes": false}}}`, InlayHintSettings{ParameterNames: true, BitCastTypes: false, Durations: true}},
+		{`{"cffc": {"inlayHints": []}}`, defaultInlayHints},
+		{`{"cffc": 1}`, defaultInlayHints},
+		{`null`, defaultInlayHints},
+	}
+	for _, tt := range tests {
+		s.DidChangeConfiguration(context.Background(), DidChangeConfigurationParams{Settings: json.RawMessage(tt.settings)})
+		if s.inlayHints != tt.want {
+			t.Errorf("%s: got %+v, want %+v", tt.settings, s.inlayHints, tt.want)
+		}
+	}
+
+	s.DidChangeConfiguration(context.Background(), DidChangeConfigurationParams{Settings: json.RawMessage(`{"cffc": {"inlayHints": {"parameterNames": false}}}`)})
+	want := []string{"9:21 : i32", "10:17 : i64"}
+	if got := inlayHints(t, s, uri, lspRange(0, 0, 12, 0)); fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("without parameter names: got %q, want %q", got, want)
+	}
+}
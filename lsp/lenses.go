@@ -0,0 +1,315 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/vyPal/go-lsp"
+)
+
+// Commands behind the Run, Build and Stop lenses. They take the path of the
+// cfconf.yaml to build and run the CaffeineC compiler next to it.
+const (
+	RunProjectCommand   = "caffeinec.runProject"
+	BuildProjectCommand = "caffeinec.buildProject"
+	StopProjectCommand  = "caffeinec.stopProject"
+)
+
+// CodeLens shows how often every function, class and exported symbol of the
+// document is referenced in the workspace and cached packages, and Run and
+// Build lenses above the main function of the file cfconf.yaml names as
+// `main`.
+func (s *Server) CodeLens(ctx context.Context, params lsp.CodeLensParams) ([]lsp.CodeLens, error) {
+	uri := params.TextDocument.URI
+	lenses := []lsp.CodeLens{}
+	if s.asts[string(uri)] == nil {
+		return lenses, nil
+	}
+	file := uriToPath(uri)
+	sc, err := s.scopesOf(file)
+	if err != nil {
+		return lenses, nil
+	}
+
+	counts := make(map[callItemData]int)
+	for _, f := range s.callFiles() {
+		for _, ref := range s.fileReferences(f) {
+			counts[ref]++
+		}
+	}
+
+	config := projectConfig(file, s.root)
+	var visit func(scope *Scope)
+	visit = func(scope *Scope) {
+		for _, b := range scope.Bindings {
+			if b.Kind != "function" && b.Kind != "method" && b.Kind != "class" && !b.Exported {
+				continue
+			}
+			n, ok := b.Node.(Node)
+			if !ok {
+				continue
+			}
+			start, end := nodeOffsets(n)
+			rng := s.fileRange(file, start, end)
+
+			if config != "" && scope.Parent == nil && b.Kind == "function" && b.Name == "main" {
+				lenses = append(lenses,
+					lsp.CodeLens{Range: rng, Command: lsp.Command{Title: "▶ Run", Command: RunProjectCommand, Arguments: []interface{}{config}}},
+					lsp.CodeLens{Range: rng, Command: lsp.Command{Title: "Build", Command: BuildProjectCommand, Arguments: []interface{}{config}}},
+				)
+				if s.running(config) {
+					lenses = append(lenses, lsp.CodeLens{Range: rng, Command: lsp.Command{Title: "■ Stop", Command: StopProjectCommand, Arguments: []interface{}{config}}})
+				}
+			}
+
+			count := counts[callItemData{File: filepath.Clean(file), Offset: b.Pos.Offset}]
+			title := fmt.Sprintf("%d references", count)
+			if count == 1 {
+				title = "1 reference"
+			}
+			lenses = append(lenses, lsp.CodeLens{Range: rng, Command: lsp.Command{Title: title}})
+		}
+		for _, c := range scope.Children {
+			// Locals of function bodies are not worth a lens.
+			if c.Class != nil && c.Function == nil {
+				visit(c)
+			}
+		}
+	}
+	visit(sc)
+	return lenses, nil
+}
+
+// referenceIndex holds the references of one version of a module: the text
+// of an open document or the modification time of a file on disk.
+type referenceIndex struct {
+	text    string
+	modTime time.Time
+	refs    []callItemData
+}
+
+// fileReferences returns referencedDeclarations for the module at file,
+// computed once per version of it.
+func (s *Server) fileReferences(file string) []callItemData {
+	if _, err := s.loadModule(file); err != nil {
+		return nil
+	}
+	uri := string(pathToURI(file))
+	version := referenceIndex{text: s.parsed[uri]}
+	if _, open := s.asts[uri]; !open {
+		version.modTime = s.modules[file].modTime
+	}
+	if idx, ok := s.references[file]; ok && idx.text == version.text && idx.modTime.Equal(version.modTime) {
+		return idx.refs
+	}
+	version.refs = s.referencedDeclarations(file)
+	s.references[file] = &version
+	return version.refs
+}
+
+// referencedDeclarations lists the declaration behind every name used in the
+// module at file: calls, instantiations, plain identifiers, assignment
+// targets and class names in type annotations.
+func (s *Server) referencedDeclarations(file string) []callItemData {
+	prog, err := s.loadModule(file)
+	if err != nil {
+		return nil
+	}
+	sc, err := s.scopesOf(file)
+	if err != nil {
+		return nil
+	}
+
+	var refs []callItemData
+	add := func(b *Binding) {
+		if b != nil {
+			refs = append(refs, callItemData{File: filepath.Clean(bindingFile(b, file)), Offset: b.Pos.Offset})
+		}
+	}
+	lookup := func(name string, offset int) *Binding {
+		if b := sc.Lookup(name, offset); b != nil {
+			return b
+		}
+		return s.importedBinding(file, prog, name)
+	}
+	class := func(name string) *Binding {
+		if isBuiltinType(strings.TrimLeft(name, "*")) {
+			return nil
+		}
+		class := s.classScope(file, prog, sc, name)
+		if class == nil {
+			return nil
+		}
+		for _, b := range class.Parent.Bindings {
+			if b.Node == class.Class {
+				return b
+			}
+		}
+		return nil
+	}
+
+	forEachFactor(prog.Statements, func(fact *Factor) {
+		switch {
+		case fact.ClassInitializer != nil:
+			add(class(fact.ClassInitializer.ClassName.Value))
+		case fact.FunctionCall != nil:
+			b, _, _ := s.callTarget(file, prog, sc, fact)
+			add(b)
+		case fact.ClassMethod != nil:
+			b, _, _ := s.callTarget(file, prog, sc, fact)
+			add(b)
+			add(lookup(fact.ClassMethod.Identifier.Name, fact.Pos.Offset))
+		case fact.Identifier != nil:
+			add(lookup(fact.Identifier.Name, fact.Pos.Offset))
+		}
+	})
+	forEachStatement(prog.Statements, func(stmt *Statement) {
+		if stmt.Assignment != nil {
+			add(lookup(stmt.Assignment.Left.Name, stmt.Pos.Offset))
+		}
+		for _, t := range statementTypes(stmt) {
+			add(class(t.Value))
+		}
+	})
+	return refs
+}
+
+// projectConfig returns the cfconf.yaml of the project whose `main` is file,
+// searching from the file's directory up to root like the extension does.
+func projectConfig(file, root string) string {
+	for dir := filepath.Dir(file); ; dir = filepath.Dir(dir) {
+		config := filepath.Join(dir, "cfconf.yaml")
+		if _, err := os.Stat(config); err == nil {
+			conf, err := GetCfConf(dir)
+			if err != nil || conf.Main == "" {
+				return ""
+			}
+			main := filepath.Join(dir, conf.Main)
+			if !strings.HasSuffix(main, ".cffc") {
+				main += ".cffc"
+			}
+			if filepath.Clean(main) != filepath.Clean(file) {
+				return ""
+			}
+			return config
+		}
+		if dir == root || dir == filepath.Dir(dir) {
+			return ""
+		}
+	}
+}
+
+// projectRun is a CaffeineC process started by a lens. done is closed once
+// the process has exited and its output has been logged.
+type projectRun struct {
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+// running reports whether a CaffeineC process for config is running.
+func (s *Server) running(config string) bool {
+	s.runsMu.Lock()
+	defer s.runsMu.Unlock()
+	return s.runs[config] != nil
+}
+
+// stopCaffeineC stops the CaffeineC process running for config, if any.
+func (s *Server) stopCaffeineC(config string) {
+	s.runsMu.Lock()
+	run := s.runs[config]
+	s.runsMu.Unlock()
+	if run != nil {
+		run.cancel()
+		<-run.done
+	}
+}
+
+// runCaffeineC runs `CaffeineC <verb> --config <config>` in the directory of
+// the config, logging its output line by line and reporting how it ended.
+// Only one process runs per config: starting another stops the previous one.
+func (s *Server) runCaffeineC(verb, config string) {
+	ctx, cancel := context.WithCancel(context.Background())
+	run := &projectRun{cancel: cancel, done: make(chan struct{})}
+	s.runsMu.Lock()
+	prev := s.runs[config]
+	s.runs[config] = run
+	s.runsMu.Unlock()
+	if prev != nil {
+		prev.cancel()
+		<-prev.done
+	}
+	defer func() {
+		s.runsMu.Lock()
+		if s.runs[config] == run {
+			delete(s.runs, config)
+		}
+		s.runsMu.Unlock()
+		cancel()
+		close(run.done)
+		s.refreshLenses()
+	}()
+
+	notify := func(typ lsp.MessageType, message string) {
+		s.conn.Notify(context.Background(), "window/showMessage", &lsp.ShowMessageParams{Type: typ, Message: message})
+	}
+	cmd := exec.CommandContext(ctx, "CaffeineC", verb, "--config", config)
+	cmd.Dir = filepath.Dir(config)
+	killGroup(cmd)
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		notify(lsp.MTError, fmt.Sprintf("CaffeineC %s failed: %s", verb, err))
+		return
+	}
+	stderr, err := cmd.StderrPipe()
+	if err != nil {
+		notify(lsp.MTError, fmt.Sprintf("CaffeineC %s failed: %s", verb, err))
+		return
+	}
+	if err := cmd.Start(); err != nil {
+		notify(lsp.MTError, fmt.Sprintf("CaffeineC %s failed: %s", verb, err))
+		return
+	}
+	s.refreshLenses()
+
+	// The pipes have to be drained before Wait closes them.
+	var wg sync.WaitGroup
+	forward := func(r io.Reader, typ lsp.MessageType) {
+		defer wg.Done()
+		scanner := bufio.NewScanner(r)
+		for scanner.Scan() {
+			s.conn.Notify(context.Background(), "window/logMessage", &lsp.LogMessageParams{Type: typ, Message: scanner.Text()})
+		}
+	}
+	wg.Add(2)
+	go forward(stdout, lsp.Log)
+	go forward(stderr, lsp.MTError)
+	wg.Wait()
+	err = cmd.Wait()
+
+	switch {
+	case ctx.Err() != nil:
+		notify(lsp.Info, fmt.Sprintf("CaffeineC %s stopped", verb))
+	case err != nil:
+		notify(lsp.MTError, fmt.Sprintf("CaffeineC %s failed: %s", verb, err))
+	default:
+		notify(lsp.Info, fmt.Sprintf("CaffeineC %s finished", verb))
+	}
+}
+
+// refreshLenses asks the client for new lenses, so the Stop lens comes and
+// goes with the process. Clients without refresh support ask again on their
+// own when the document changes.
+func (s *Server) refreshLenses() {
+	if !s.lensRefresh {
+		return
+	}
+	s.conn.Call(context.Background(), "workspace/codeLens/refresh", nil, nil)
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/vyPal/go-lsp"
+)
+
+type DocumentLinkParams struct {
+	TextDocument lsp.TextDocumentIdentifier `json:"textDocument"`
+}
+
+type DocumentLink struct {
+	Range   lsp.Range       `json:"range"`
+	Target  lsp.DocumentURI `json:"target,omitempty"`
+	Tooltip string          `json:"tooltip,omitempty"`
+}
+
+type DocumentLinkOptions struct {
+	ResolveProvider bool `json:"resolveProvider"`
+}
+
+// isCfConf reports whether uri is a package configuration file, which the
+// server keeps for document links but does not parse as CaffeineC.
+func isCfConf(uri lsp.DocumentURI) bool {
+	return filepath.Base(uriToPath(uri)) == "cfconf.yaml"
+}
+
+// DocumentLink makes import strings and the dependencies of cfconf.yaml
+// clickable. Imports link to the .cffc file they resolve to, or to the
+// package directory when the file does not exist; dependencies link to the
+// directory of the cached package.
+func (s *Server) DocumentLink(ctx context.Context, params DocumentLinkParams) ([]DocumentLink, error) {
+	uri := params.TextDocument.URI
+	if isCfConf(uri) {
+		return dependencyLinks(s.documents[string(uri)]), nil
+	}
+
+	links := []DocumentLink{}
+	prog := s.asts[string(uri)]
+	if prog == nil {
+		return links, nil
+	}
+	doc, parsed := s.documents[string(uri)], s.parsed[string(uri)]
+	docDir := filepath.Dir(uriToPath(uri))
+
+	for _, stmt := range prog.Statements {
+		pkg := importedPackage(stmt)
+		if pkg == "" {
+			continue
+		}
+		t, ok := nameToken(stmt.Tokens, "\""+pkg+"\"")
+		if !ok {
+			continue
+		}
+		start, end := t.Pos.Offset+1, t.Pos.Offset+len(t.Value)-1
+		from, to := s.docOffset(uri, start), s.docOffset(uri, end)
+		if to > len(doc) || doc[from:to] != parsed[start:end] {
+			continue
+		}
+
+		link := DocumentLink{Range: offsetRange(doc, from, to)}
+		file, err := resolveImportFile(pkg, docDir, cache)
+		if err != nil {
+			continue
+		}
+		found, p, _, err := cache.ResolvePackage(pkg)
+		if err != nil {
+			continue
+		}
+		if found {
+			link.Tooltip = fmt.Sprintf("%s@%s", p.Identifier, p.Version)
+		} else if rel, err := filepath.Rel(docDir, file); err == nil {
+			link.Tooltip = filepath.ToSlash(rel)
+		}
+
+		if _, err := os.Stat(file); err == nil {
+			link.Target = pathToURI(file)
+		} else if found {
+			link.Target = pathToURI(p.Path)
+		} else {
+			continue
+		}
+		links = append(links, link)
+	}
+	return links, nil
+}
+
+// dependencyLinks links the entries of the dependencies list in the text of a
+// cfconf.yaml to the cached packages they name. The identifier is linked, or
+// the package name for entries without one.
+func dependencyLinks(doc string) []DocumentLink {
+	links := []DocumentLink{}
+	for _, dep := range cfconfDependencies(doc) {
+		p, err := cache.GetPackage(dep.Package, dep.Version, dep.Identifier)
+		if err != nil || p.Path == "" {
+			continue
+		}
+		start, end := dep.identifier[0], dep.identifier[1]
+		if end == 0 {
+			start, end = dep.pkg[0], dep.pkg[1]
+		}
+		links = append(links, DocumentLink{
+			Range:   offsetRange(doc, start, end),
+			Target:  pathToURI(p.Path),
+			Tooltip: fmt.Sprintf("%s@%s", p.Identifier, p.Version),
+		})
+	}
+	return links
+}
+
+// dependencyEntry is an item of the dependencies list of a cfconf.yaml with
+// the offsets of its package and identifier values.
+type dependencyEntry struct {
+	CFConfDependency
+	pkg, identifier [2]int
+}
+
+// cfconfDependencies reads the dependencies list of a cfconf.yaml line by
+// line, as the yaml decoder does not report where values are.
+func cfconfDependencies(doc string) []dependencyEntry {
+	var deps []dependencyEntry
+	var cur *dependencyEntry
+	flush := func() {
+		if cur != nil {
+			deps = append(deps, *cur)
+			cur = nil
+		}
+	}
+
+	inDeps := false
+	offset := 0
+	for _, line := range strings.SplitAfter(doc, "\n") {
+		lineStart := offset
+		offset += len(line)
+		line = strings.TrimRight(line, "\r\n")
+		trimmed := strings.TrimSpace(line)
+		if trimmed == "" || strings.HasPrefix(trimmed, "#") {
+			continue
+		}
+		if line[0] != ' ' && line[0] != '-' {
+			flush()
+			inDeps = strings.HasPrefix(trimmed, "dependencies:")
+			continue
+		}
+		if !inDeps {
+			continue
+		}
+
+		col := len(line) - len(strings.TrimLeft(line, " "))
+		if strings.HasPrefix(line[col:], "-") {
+			flush()
+			cur = &dependencyEntry{}
+			col++
+			col += len(line[col:]) - len(strings.TrimLeft(line[col:], " "))
+		}
+		colon := strings.IndexByte(line[col:], ':')
+		if cur == nil || colon < 0 {
+			continue
+		}
+		key := line[col : col+colon]
+
+		// The value runs to the end of the line or a comment, without quotes.
+		start := col + colon + 1
+		end := len(line)
+		if hash := strings.Index(line[start:], " #"); hash >= 0 {
+			end = start + hash
+		}
+		start += len(line[start:end]) - len(strings.TrimLeft(line[start:end], " "))
+		end = start + len(strings.TrimRight(line[start:end], " "))
+		if end-start >= 2 && (line[start] == '"' || line[start] == '\'') && line[end-1] == line[start] {
+			start, end = start+1, end-1
+		}
+		value, span := line[start:end], [2]int{lineStart + start, lineStart + end}
+
+		switch key {
+		case "package":
+			cur.Package, cur.pkg = value, span
+		case "version":
+			cur.Version = value
+		case "identifier":
+			cur.Identifier, cur.identifier = value, span
+		}
+	}
+	flush()
+	return deps
+}
@@ -6,7 +6,6 @@ import (
 	"flag"
 	"fmt"
 	"net"
-	"strings"
 
 	"github.com/alecthomas/participle/v2"
 	"github.com/sourcegraph/jsonrpc2"
@@ -21,8 +20,6 @@ var ast *Program
 
 var server *Server
 
-var SymbolTable = make(map[string]CTSymbol)
-
 var cache PackageCache
 
 type CTSymbol struct {
@@ -47,9 +44,15 @@ func (h *handler) Handle(ctx context.Context, conn *jsonrpc2.Conn, req *jsonrpc2
 			})
 			return
 		}
+		client := &InitializeCapabilities{}
+		if err := json.Unmarshal(*req.Params, client); err == nil {
+			positionEncoding = negotiateEncoding(client.Capabilities.General.PositionEncodings)
+		}
 
 		parser = participle.MustBuild[Program]()
-		server = &Server{conn: conn, documents: make(map[string]string), asts: make(map[string]*Program)}
+		server = &Server{conn: conn, documents: make(map[string]string), asts: make(map[string]*Program), parsed: make(map[string]string), semantic: make(map[string]lsp.SemanticTokens), inlayHints: defaultInlayHints, modules: make(map[string]*moduleInfo), references: make(map[string]*referenceIndex), runs: make(map[string]*projectRun), root: uriToPath(params.Root())}
+		server.lensRefresh = client.Capabilities.Workspace.CodeLens.RefreshSupport
+		server.hintRefresh = client.Capabilities.Workspace.InlayHint.RefreshSupport
 
 		cache = PackageCache{}
 		err := cache.Init()
@@ -67,63 +70,44 @@ func (h *handler) Handle(ctx context.Context, conn *jsonrpc2.Conn, req *jsonrpc2
 			})
 		}
 
-		res := &lsp.InitializeResult{
-			Capabilities: lsp.ServerCapabilities{
-				TextDocumentSync: &lsp.TextDocumentSyncOptionsOrKind{
-					Options: &lsp.TextDocumentSyncOptions{
-						OpenClose: true,
-						Change:    lsp.TDSKFull,
-					},
-				},
-				CompletionProvider: &lsp.CompletionOptions{
-					TriggerCharacters: []string{"."},
-				},
-				HoverProvider: true,
-				SemanticTokensProvider: &lsp.SemanticTokensOptions{
-					Legend: lsp.SemanticTokensLegend{
-						TokenTypes: []string{
-							"namespace",
-							"class",
-							"enum",
-							"interface",
-							"struct",
-							"typeParameter",
-							"type",
-							"parameter",
-							"variable",
-							"property",
-							"enumMember",
-							"decorator",
-							"event",
-							"function",
-							"method",
-							"macro",
-							"label",
-							"comment",
-							"string",
-							"keyword",
-							"number",
-							"regexp",
-							"operator",
-						},
-						TokenModifiers: []string{
-							"declaration",
-							"definition",
-							"readonly",
-							"static",
-							"deprecated",
-							"abstract",
-							"async",
-							"modification",
-							"documentation",
-							"defaultLibrary",
+		res := &InitializeResult{
+			Capabilities: ServerCapabilities{
+				ServerCapabilities: lsp.ServerCapabilities{
+					TextDocumentSync: &lsp.TextDocumentSyncOptionsOrKind{
+						Options: &lsp.TextDocumentSyncOptions{
+							OpenClose: true,
+							Change:    lsp.TDSKFull,
 						},
 					},
-					Full: lsp.STPFFull,
-					DocumentSelector: lsp.DocumentSelector{
-						lsp.DocumentFilter{Language: "cffc"},
+					CompletionProvider: &lsp.CompletionOptions{
+						ResolveProvider:   true,
+						TriggerCharacters: []string{"."},
+					},
+					SignatureHelpProvider: &lsp.SignatureHelpOptions{
+						TriggerCharacters: []string{"(", ","},
+					},
+					ExecuteCommandProvider: &lsp.ExecuteCommandOptions{
+						Commands: []string{CompletionAcceptedCommand, RunProjectCommand, BuildProjectCommand, StopProjectCommand},
+					},
+					HoverProvider:             true,
+					CodeActionProvider:        true,
+					DocumentHighlightProvider: true,
+					CodeLensProvider:          &lsp.CodeLensOptions{},
+					SemanticTokensProvider: &lsp.SemanticTokensOptions{
+						Legend: semanticTokensLegend,
+						Range:  true,
+						Full:   lsp.STPFFullDelta,
+						DocumentSelector: lsp.DocumentSelector{
+							lsp.DocumentFilter{Language: "cffc"},
+						},
 					},
 				},
+				PositionEncoding:       positionEncoding,
+				FoldingRangeProvider:   true,
+				SelectionRangeProvider: true,
+				DocumentLinkProvider:   &DocumentLinkOptions{},
+				CallHierarchyProvider:  true,
+				InlayHintProvider:      true,
 			},
 		}
 
@@ -141,22 +125,6 @@ func (h *handler) Handle(ctx context.Context, conn *jsonrpc2.Conn, req *jsonrpc2
 			})
 			return
 		}
-		var err error
-		if e := TryCatch(func() {
-			ast, err = parser.Parse("", strings.NewReader(params.ContentChanges[0].Text))
-		})(); e != nil {
-			DecodeError(e.Error(), conn, params.TextDocument.URI, ctx)
-			return
-		}
-		if err != nil {
-			DecodeError(err.Error(), conn, params.TextDocument.URI, ctx)
-			return
-		} else {
-			conn.Notify(ctx, "textDocument/publishDiagnostics", lsp.PublishDiagnosticsParams{
-				URI: params.TextDocument.URI, Diagnostics: []lsp.Diagnostic{},
-			})
-		}
-
 		server.DidChange(conn, ctx, params.TextDocument.URI, params.ContentChanges[0].Text)
 
 		conn.Reply(ctx, req.ID, nil)
@@ -172,6 +140,48 @@ func (h *handler) Handle(ctx context.Context, conn *jsonrpc2.Conn, req *jsonrpc2
 
 		conn.Reply(ctx, req.ID, nil)
 
+	case "textDocument/foldingRange":
+		params := &FoldingRangeParams{}
+		if err := json.Unmarshal(*req.Params, params); err != nil {
+			conn.Notify(ctx, "window/showMessage", &lsp.ShowMessageParams{
+				Type:    lsp.MTError,
+				Message: err.Error(),
+			})
+			return
+		}
+
+		ranges, err := server.FoldingRange(ctx, *params)
+		if err != nil {
+			conn.Notify(ctx, "window/showMessage", &lsp.ShowMessageParams{
+				Type:    lsp.MTError,
+				Message: err.Error(),
+			})
+			return
+		}
+
+		conn.Reply(ctx, req.ID, ranges)
+
+	case "textDocument/selectionRange":
+		params := &SelectionRangeParams{}
+		if err := json.Unmarshal(*req.Params, params); err != nil {
+			conn.Notify(ctx, "window/showMessage", &lsp.ShowMessageParams{
+				Type:    lsp.MTError,
+				Message: err.Error(),
+			})
+			return
+		}
+
+		ranges, err := server.SelectionRange(ctx, *params)
+		if err != nil {
+			conn.Notify(ctx, "window/showMessage", &lsp.ShowMessageParams{
+				Type:    lsp.MTError,
+				Message: err.Error(),
+			})
+			return
+		}
+
+		conn.Reply(ctx, req.ID, ranges)
+
 	case "textDocument/semanticTokens/full":
 		params := &lsp.SemanticTokensParams{}
 		if err := json.Unmarshal(*req.Params, params); err != nil {
@@ -182,7 +192,58 @@ func (h *handler) Handle(ctx context.Context, conn *jsonrpc2.Conn, req *jsonrpc2
 			return
 		}
 
-		server.AnalyzeAst(ctx, req, params.TextDocument.URI)
+		tokens, err := server.SemanticTokens(ctx, *params)
+		if err != nil {
+			conn.Notify(ctx, "window/showMessage", &lsp.ShowMessageParams{
+				Type:    lsp.MTError,
+				Message: err.Error(),
+			})
+			return
+		}
+
+		conn.Reply(ctx, req.ID, tokens)
+
+	case "textDocument/semanticTokens/range":
+		params := &SemanticTokensRangeParams{}
+		if err := json.Unmarshal(*req.Params, params); err != nil {
+			conn.Notify(ctx, "window/showMessage", &lsp.ShowMessageParams{
+				Type:    lsp.MTError,
+				Message: err.Error(),
+			})
+			return
+		}
+
+		tokens, err := server.SemanticTokensRange(ctx, *params)
+		if err != nil {
+			conn.Notify(ctx, "window/showMessage", &lsp.ShowMessageParams{
+				Type:    lsp.MTError,
+				Message: err.Error(),
+			})
+			return
+		}
+
+		conn.Reply(ctx, req.ID, tokens)
+
+	case "textDocument/semanticTokens/full/delta":
+		params := &SemanticTokensDeltaParams{}
+		if err := json.Unmarshal(*req.Params, params); err != nil {
+			conn.Notify(ctx, "window/showMessage", &lsp.ShowMessageParams{
+				Type:    lsp.MTError,
+				Message: err.Error(),
+			})
+			return
+		}
+
+		delta, err := server.SemanticTokensDelta(ctx, *params)
+		if err != nil {
+			conn.Notify(ctx, "window/showMessage", &lsp.ShowMessageParams{
+				Type:    lsp.MTError,
+				Message: err.Error(),
+			})
+			return
+		}
+
+		conn.Reply(ctx, req.ID, delta)
 
 	case "textDocument/hover":
 		params := &HoverParams{}
@@ -205,6 +266,174 @@ func (h *handler) Handle(ctx context.Context, conn *jsonrpc2.Conn, req *jsonrpc2
 
 		conn.Reply(ctx, req.ID, hover)
 
+	case "textDocument/documentHighlight":
+		params := &lsp.TextDocumentPositionParams{}
+		if err := json.Unmarshal(*req.Params, params); err != nil {
+			conn.Notify(ctx, "window/showMessage", &lsp.ShowMessageParams{
+				Type:    lsp.MTError,
+				Message: err.Error(),
+			})
+			return
+		}
+
+		highlights, err := server.DocumentHighlight(ctx, *params)
+		if err != nil {
+			conn.Notify(ctx, "window/showMessage", &lsp.ShowMessageParams{
+				Type:    lsp.MTError,
+				Message: err.Error(),
+			})
+			return
+		}
+
+		conn.Reply(ctx, req.ID, highlights)
+
+	case "textDocument/documentLink":
+		params := &DocumentLinkParams{}
+		if err := json.Unmarshal(*req.Params, params); err != nil {
+			conn.Notify(ctx, "window/showMessage", &lsp.ShowMessageParams{
+				Type:    lsp.MTError,
+				Message: err.Error(),
+			})
+			return
+		}
+
+		links, err := server.DocumentLink(ctx, *params)
+		if err != nil {
+			conn.Notify(ctx, "window/showMessage", &lsp.ShowMessageParams{
+				Type:    lsp.MTError,
+				Message: err.Error(),
+			})
+			return
+		}
+
+		conn.Reply(ctx, req.ID, links)
+
+	case "textDocument/prepareCallHierarchy":
+		params := &lsp.TextDocumentPositionParams{}
+		if err := json.Unmarshal(*req.Params, params); err != nil {
+			conn.Notify(ctx, "window/showMessage", &lsp.ShowMessageParams{
+				Type:    lsp.MTError,
+				Message: err.Error(),
+			})
+			return
+		}
+
+		items, err := server.PrepareCallHierarchy(ctx, *params)
+		if err != nil {
+			conn.Notify(ctx, "window/showMessage", &lsp.ShowMessageParams{
+				Type:    lsp.MTError,
+				Message: err.Error(),
+			})
+			return
+		}
+
+		conn.Reply(ctx, req.ID, items)
+
+	case "callHierarchy/incomingCalls":
+		params := &CallHierarchyIncomingCallsParams{}
+		if err := json.Unmarshal(*req.Params, params); err != nil {
+			conn.Notify(ctx, "window/showMessage", &lsp.ShowMessageParams{
+				Type:    lsp.MTError,
+				Message: err.Error(),
+			})
+			return
+		}
+
+		calls, err := server.IncomingCalls(ctx, *params)
+		if err != nil {
+			conn.Notify(ctx, "window/showMessage", &lsp.ShowMessageParams{
+				Type:    lsp.MTError,
+				Message: err.Error(),
+			})
+			return
+		}
+
+		conn.Reply(ctx, req.ID, calls)
+
+	case "callHierarchy/outgoingCalls":
+		params := &CallHierarchyOutgoingCallsParams{}
+		if err := json.Unmarshal(*req.Params, params); err != nil {
+			conn.Notify(ctx, "window/showMessage", &lsp.ShowMessageParams{
+				Type:    lsp.MTError,
+				Message: err.Error(),
+			})
+			return
+		}
+
+		calls, err := server.OutgoingCalls(ctx, *params)
+		if err != nil {
+			conn.Notify(ctx, "window/showMessage", &lsp.ShowMessageParams{
+				Type:    lsp.MTError,
+				Message: err.Error(),
+			})
+			return
+		}
+
+		conn.Reply(ctx, req.ID, calls)
+
+	case "textDocument/codeLens":
+		params := &lsp.CodeLensParams{}
+		if err := json.Unmarshal(*req.Params, params); err != nil {
+			conn.Notify(ctx, "window/showMessage", &lsp.ShowMessageParams{
+				Type:    lsp.MTError,
+				Message: err.Error(),
+			})
+			return
+		}
+
+		lenses, err := server.CodeLens(ctx, *params)
+		if err != nil {
+			conn.Notify(ctx, "window/showMessage", &lsp.ShowMessageParams{
+				Type:    lsp.MTError,
+				Message: err.Error(),
+			})
+			return
+		}
+
+		conn.Reply(ctx, req.ID, lenses)
+
+	case "textDocument/inlayHint":
+		params := &InlayHintParams{}
+		if err := json.Unmarshal(*req.Params, params); err != nil {
+			conn.Notify(ctx, "window/showMessage", &lsp.ShowMessageParams{
+				Type:    lsp.MTError,
+				Message: err.Error(),
+			})
+			return
+		}
+
+		hints, err := server.InlayHint(ctx, *params)
+		if err != nil {
+			conn.Notify(ctx, "window/showMessage", &lsp.ShowMessageParams{
+				Type:    lsp.MTError,
+				Message: err.Error(),
+			})
+			return
+		}
+
+		conn.Reply(ctx, req.ID, hints)
+
+	case "textDocument/codeAction":
+		params := &CodeActionParams{}
+		if err := json.Unmarshal(*req.Params, params); err != nil {
+			conn.Notify(ctx, "window/showMessage", &lsp.ShowMessageParams{
+				Type:    lsp.MTError,
+				Message: err.Error(),
+			})
+			return
+		}
+
+		actions, err := server.CodeAction(ctx, *params)
+		if err != nil {
+			conn.Notify(ctx, "window/showMessage", &lsp.ShowMessageParams{
+				Type:    lsp.MTError,
+				Message: err.Error(),
+			})
+			return
+		}
+
+		conn.Reply(ctx, req.ID, actions)
+
 	/*
 		case "textDocument/completion":
 			params := &lsp.CompletionParams{}
@@ -255,7 +484,93 @@ func (h *handler) Handle(ctx context.Context, conn *jsonrpc2.Conn, req *jsonrpc2
 			return
 		}
 
-		conn.Reply(ctx, req.ID, lsp.CompletionList{IsIncomplete: true, Items: completions.Items})
+		conn.Reply(ctx, req.ID, CompletionList{IsIncomplete: true, Items: completions.Items})
+	case "textDocument/signatureHelp":
+		params := &lsp.TextDocumentPositionParams{}
+		if err := json.Unmarshal(*req.Params, params); err != nil {
+			conn.Notify(ctx, "window/showMessage", &lsp.ShowMessageParams{
+				Type:    lsp.MTError,
+				Message: err.Error(),
+			})
+			return
+		}
+
+		help, err := server.SignatureHelp(ctx, *params)
+		if err != nil {
+			conn.Notify(ctx, "window/showMessage", &lsp.ShowMessageParams{
+				Type:    lsp.MTError,
+				Message: err.Error(),
+			})
+			return
+		}
+
+		conn.Reply(ctx, req.ID, help)
+	case "completionItem/resolve":
+		params := &CompletionItem{}
+		if err := json.Unmarshal(*req.Params, params); err != nil {
+			conn.Notify(ctx, "window/showMessage", &lsp.ShowMessageParams{
+				Type:    lsp.MTError,
+				Message: err.Error(),
+			})
+			return
+		}
+
+		item, err := server.ResolveCompletion(ctx, *params)
+		if err != nil {
+			conn.Notify(ctx, "window/showMessage", &lsp.ShowMessageParams{
+				Type:    lsp.MTError,
+				Message: err.Error(),
+			})
+			return
+		}
+
+		conn.Reply(ctx, req.ID, item)
+	case "workspace/didChangeConfiguration":
+		// Settings the server cannot read fall back to their defaults.
+		params := &DidChangeConfigurationParams{}
+		json.Unmarshal(*req.Params, params)
+		server.DidChangeConfiguration(ctx, *params)
+
+		conn.Reply(ctx, req.ID, nil)
+
+	case "workspace/didChangeWatchedFiles":
+		params := &lsp.DidChangeWatchedFilesParams{}
+		if err := json.Unmarshal(*req.Params, params); err != nil {
+			conn.Notify(ctx, "window/showMessage", &lsp.ShowMessageParams{
+				Type:    lsp.MTError,
+				Message: err.Error(),
+			})
+			return
+		}
+		if err := server.DidChangeWatchedFiles(ctx, *params); err != nil {
+			conn.Notify(ctx, "window/showMessage", &lsp.ShowMessageParams{
+				Type:    lsp.MTError,
+				Message: err.Error(),
+			})
+		}
+
+		conn.Reply(ctx, req.ID, nil)
+
+	case "workspace/executeCommand":
+		params := &lsp.ExecuteCommandParams{}
+		if err := json.Unmarshal(*req.Params, params); err != nil {
+			conn.Notify(ctx, "window/showMessage", &lsp.ShowMessageParams{
+				Type:    lsp.MTError,
+				Message: err.Error(),
+			})
+			return
+		}
+
+		res, err := server.ExecuteCommand(ctx, *params)
+		if err != nil {
+			conn.Notify(ctx, "window/showMessage", &lsp.ShowMessageParams{
+				Type:    lsp.MTError,
+				Message: err.Error(),
+			})
+			return
+		}
+
+		conn.Reply(ctx, req.ID, res)
 	default:
 		fmt.Println("Unknown method: ", req.Method)
 	}
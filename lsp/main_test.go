@@ -0,0 +1,122 @@
+package main
+
+import (
+	"context"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+
+	"github.com/alecthomas/participle/v2"
+	"github.com/sourcegraph/jsonrpc2"
+	"github.com/vyPal/go-lsp"
+)
+
+// discard answers nothing; the client end of the test connection ignores
+// what the server sends it.
+type discard struct{}
+
+func (discard) Handle(context.Context, *jsonrpc2.Conn, *jsonrpc2.Request) {}
+
+// newTestServer writes files into a temporary workspace and returns a server
+// rooted there, connected to a client that ignores its notifications.
+func newTestServer(t *testing.T, files map[string]string) (*Server, string) {
+	t.Helper()
+	dir := t.TempDir()
+	for name, content := range files {
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	serverEnd, clientEnd := net.Pipe()
+	client := jsonrpc2.NewConn(context.Background(), jsonrpc2.NewBufferedStream(clientEnd, jsonrpc2.VSCodeObjectCodec{}), discard{})
+	conn := jsonrpc2.NewConn(context.Background(), jsonrpc2.NewBufferedStream(serverEnd, jsonrpc2.VSCodeObjectCodec{}), discard{})
+	t.Cleanup(func() {
+		conn.Close()
+		client.Close()
+	})
+
+	parser = participle.MustBuild[Program]()
+	cache = PackageCache{}
+	server = &Server{conn: conn, documents: make(map[string]string), asts: make(map[string]*Program), parsed: make(map[string]string), semantic: make(map[string]lsp.SemanticTokens), inlayHints: defaultInlayHints, modules: make(map[string]*moduleInfo), references: make(map[string]*referenceIndex), runs: make(map[string]*projectRun), root: dir}
+	return server, dir
+}
+
+// openDocument loads a workspace file into the server as if the client had
+// opened it.
+func openDocument(t *testing.T, s *Server, dir, name string) lsp.DocumentURI {
+	t.Helper()
+	path := filepath.Join(dir, name)
+	text, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	uri := pathToURI(path)
+	s.DidChange(s.conn, context.Background(), uri, string(text))
+	return uri
+}
+
+// editDocument replaces the text of an open document.
+func editDocument(s *Server, uri lsp.DocumentURI, text string) {
+	s.DidChange(s.conn, context.Background(), uri, text)
+}
+
+func lspRange(startLine, startChar, endLine, endChar int) lsp.Range {
+	return lsp.Range{
+		Start: lsp.Position{Line: startLine, Character: startChar},
+		End:   lsp.Position{Line: endLine, Character: endChar},
+	}
+}
+
+// codeActions requests the actions of the given kinds for a range.
+func codeActions(t *testing.T, s *Server, uri lsp.DocumentURI, rng lsp.Range, only ...lsp.CodeActionKind) []CodeAction {
+	t.Helper()
+	actions, err := s.CodeAction(context.Background(), CodeActionParams{
+		TextDocument: lsp.TextDocumentIdentifier{URI: uri},
+		Range:        rng,
+		Context:      CodeActionContext{Only: only},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return actions
+}
+
+// findAction returns the action with the given title, failing the test when
+// there is none.
+func findAction(t *testing.T, actions []CodeAction, title string) CodeAction {
+	t.Helper()
+	var titles []string
+	for _, a := range actions {
+		if a.Title == title {
+			return a
+		}
+		titles = append(titles, a.Title)
+	}
+	t.Fatalf("no action %q among %q", title, titles)
+	return CodeAction{}
+}
+
+// applyAction returns the text of the document after the action's edits.
+func applyAction(t *testing.T, s *Server, uri lsp.DocumentURI, action CodeAction) string {
+	t.Helper()
+	if action.Edit == nil {
+		t.Fatalf("action %q has no edit", action.Title)
+	}
+	doc := s.documents[string(uri)]
+	edits := append([]lsp.TextEdit(nil), action.Edit.Changes[string(uri)]...)
+	sort.SliceStable(edits, func(i, j int) bool {
+		return positionToOffset(doc, edits[i].Range.Start) > positionToOffset(doc, edits[j].Range.Start)
+	})
+	for _, e := range edits {
+		start, end := positionToOffset(doc, e.Range.Start), positionToOffset(doc, e.Range.End)
+		doc = doc[:start] + e.NewText + doc[end:]
+	}
+	return doc
+}
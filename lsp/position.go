@@ -0,0 +1,142 @@
+package main
+
+import (
+	"strings"
+	"unicode/utf8"
+
+	"github.com/vyPal/go-lsp"
+)
+
+// Position encodings of LSP 3.17. The character of an lsp.Position counts
+// units of the encoding agreed on in initialize, while everything inside the
+// server works with byte offsets. The functions below are the only place the
+// two are converted.
+const (
+	encodingUTF8  = "utf-8"
+	encodingUTF16 = "utf-16"
+	encodingUTF32 = "utf-32"
+)
+
+// positionEncoding is the encoding negotiated with the client. Clients that
+// do not offer any use UTF-16.
+var positionEncoding = encodingUTF16
+
+// InitializeCapabilities holds the client capabilities go-lsp does not decode.
+type InitializeCapabilities struct {
+	Capabilities struct {
+		General struct {
+			PositionEncodings []string `json:"positionEncodings"`
+		} `json:"general"`
+		Workspace struct {
+			CodeLens struct {
+				RefreshSupport bool `json:"refreshSupport"`
+			} `json:"codeLens"`
+			InlayHint struct {
+				RefreshSupport bool `json:"refreshSupport"`
+			} `json:"inlayHint"`
+		} `json:"workspace"`
+	} `json:"capabilities"`
+}
+
+// InitializeResult mirrors lsp.InitializeResult with the negotiated encoding.
+type InitializeResult struct {
+	Capabilities ServerCapabilities `json:"capabilities"`
+}
+
+// ServerCapabilities adds the capabilities go-lsp has no fields for.
+type ServerCapabilities struct {
+	lsp.ServerCapabilities
+	PositionEncoding       string               `json:"positionEncoding,omitempty"`
+	FoldingRangeProvider   bool                 `json:"foldingRangeProvider,omitempty"`
+	SelectionRangeProvider bool                 `json:"selectionRangeProvider,omitempty"`
+	DocumentLinkProvider   *DocumentLinkOptions `json:"documentLinkProvider,omitempty"`
+	CallHierarchyProvider  bool                 `json:"callHierarchyProvider,omitempty"`
+	InlayHintProvider      bool                 `json:"inlayHintProvider,omitempty"`
+}
+
+// negotiateEncoding picks the encoding to use from those the client offers.
+// UTF-8 is preferred as it needs no conversion, then the client's order.
+func negotiateEncoding(offered []string) string {
+	for _, e := range offered {
+		if e == encodingUTF8 {
+			return e
+		}
+	}
+	for _, e := range offered {
+		if e == encodingUTF16 || e == encodingUTF32 {
+			return e
+		}
+	}
+	return encodingUTF16
+}
+
+// encodedLen counts the units of the negotiated encoding needed for s.
+func encodedLen(s string) int {
+	switch positionEncoding {
+	case encodingUTF8:
+		return len(s)
+	case encodingUTF32:
+		return utf8.RuneCountInString(s)
+	}
+	n := 0
+	for _, r := range s {
+		if r >= 0x10000 {
+			n += 2
+		} else {
+			n++
+		}
+	}
+	return n
+}
+
+// byteColumn returns how many bytes of line the first character units of the
+// negotiated encoding cover. A position inside a character rounds down to
+// its start and positions past the end clamp to the line length.
+func byteColumn(line string, character int) int {
+	if positionEncoding == encodingUTF8 {
+		if character > len(line) {
+			return len(line)
+		}
+		return character
+	}
+	units := 0
+	for i, r := range line {
+		size := 1
+		if positionEncoding == encodingUTF16 && r >= 0x10000 {
+			size = 2
+		}
+		if units+size > character {
+			return i
+		}
+		units += size
+	}
+	return len(line)
+}
+
+func offsetToPosition(doc string, offset int) lsp.Position {
+	if offset > len(doc) {
+		offset = len(doc)
+	}
+	lineStart := strings.LastIndex(doc[:offset], "\n") + 1
+	return lsp.Position{Line: strings.Count(doc[:offset], "\n"), Character: encodedLen(doc[lineStart:offset])}
+}
+
+func positionToOffset(doc string, pos lsp.Position) int {
+	offset := 0
+	for i := 0; i < pos.Line; i++ {
+		next := strings.IndexByte(doc[offset:], '\n')
+		if next < 0 {
+			return len(doc)
+		}
+		offset += next + 1
+	}
+	end := strings.IndexByte(doc[offset:], '\n')
+	if end < 0 {
+		end = len(doc) - offset
+	}
+	return offset + byteColumn(doc[offset:offset+end], pos.Character)
+}
+
+func offsetRange(doc string, start, end int) lsp.Range {
+	return lsp.Range{Start: offsetToPosition(doc, start), End: offsetToPosition(doc, end)}
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"testing"
+	"unicode/utf8"
+
+	"github.com/vyPal/go-lsp"
+)
+
+// useEncoding switches the negotiated encoding for the rest of the test.
+func useEncoding(t *testing.T, encoding string) {
+	previous := positionEncoding
+	positionEncoding = encoding
+	t.Cleanup(func() { positionEncoding = previous })
+}
+
+func TestNegotiateEncoding(t *testing.T) {
+	tests := []struct {
+		offered []string
+		want    string
+	}{
+		{nil, encodingUTF16},
+		{[]string{encodingUTF16, encodingUTF8}, encodingUTF8},
+		{[]string{encodingUTF32, encodingUTF16}, encodingUTF32},
+		{[]string{"utf-7"}, encodingUTF16},
+	}
+	for _, tt := range tests {
+		if got := negotiateEncoding(tt.offered); got != tt.want {
+			t.Errorf("negotiateEncoding(%q) = %q, want %q", tt.offered, got, tt.want)
+		}
+	}
+}
+
+func TestEncodedLen(t *testing.T) {
+	// "é" is two bytes and one UTF-16 unit, "😀" four bytes and a surrogate
+	// pair.
+	s := "aé😀"
+	tests := []struct {
+		encoding string
+		want     int
+	}{
+		{encodingUTF8, 7},
+		{encodingUTF16, 4},
+		{encodingUTF32, 3},
+	}
+	for _, tt := range tests {
+		useEncoding(t, tt.encoding)
+		if got := encodedLen(s); got != tt.want {
+			t.Errorf("%s: encodedLen(%q) = %d, want %d", tt.encoding, s, got, tt.want)
+		}
+	}
+}
+
+func TestByteColumn(t *testing.T) {
+	line := "aé😀b"
+	tests := []struct {
+		encoding  string
+		character int
+		want      int
+	}{
+		{encodingUTF16, 0, 0},
+		{encodingUTF16, 1, 1},
+		{encodingUTF16, 2, 3},
+		// Between the halves of the surrogate pair rounds down to the
+		// start of the character.
+		{encodingUTF16, 3, 3},
+		{encodingUTF16, 4, 7},
+		{encodingUTF16, 5, 8},
+		{encodingUTF16, 9, 8},
+		{encodingUTF32, 3, 7},
+		{encodingUTF32, 4, 8},
+		{encodingUTF8, 3, 3},
+		{encodingUTF8, 20, 8},
+	}
+	for _, tt := range tests {
+		useEncoding(t, tt.encoding)
+		if got := byteColumn(line, tt.character); got != tt.want {
+			t.Errorf("%s: byteColumn(%q, %d) = %d, want %d", tt.encoding, line, tt.character, got, tt.want)
+		}
+	}
+}
+
+func TestPositionRoundTrip(t *testing.T) {
+	useEncoding(t, encodingUTF16)
+	doc := "var s: string = \"😀\";\nprint(s);\n"
+	for offset := 0; offset <= len(doc); offset++ {
+		if offset < len(doc) && !utf8.RuneStart(doc[offset]) {
+			continue
+		}
+		pos := offsetToPosition(doc, offset)
+		if back := positionToOffset(doc, pos); back != offset {
+			t.Errorf("offset %d: position %v maps back to %d", offset, pos, back)
+		}
+	}
+	if got, want := offsetToPosition(doc, len("var s: string = \"😀")), (lsp.Position{Line: 0, Character: 19}); got != want {
+		t.Errorf("position after the emoji = %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,15 @@
+package main
+
+import (
+	"os/exec"
+	"strconv"
+)
+
+// killGroup cancels cmd by killing its whole process tree, so programs
+// started by CaffeineC stop with it. Windows has no process groups to signal,
+// so taskkill walks the tree instead.
+func killGroup(cmd *exec.Cmd) {
+	cmd.Cancel = func() error {
+		return exec.Command("taskkill", "/T", "/F", "/PID", strconv.Itoa(cmd.Process.Pid)).Run()
+	}
+}
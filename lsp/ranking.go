@@ -0,0 +1,269 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"unicode"
+
+	"github.com/vyPal/go-lsp"
+)
+
+// Completion tiers, best first. Items of a lower tier sort before items of a
+// higher one with the same recency.
+const (
+	tierLocal = iota
+	tierGlobal
+	tierKeyword
+	tierImported
+	tierAutoImport
+)
+
+// CompletionAcceptedCommand is attached to every completion item so the
+// client reports which items get picked.
+const CompletionAcceptedCommand = "caffeinec.completionAccepted"
+
+// maxRecent is how many accepted completions are remembered for ranking.
+const maxRecent = 50
+
+// completionData is sent along with a completion item so that
+// completionItem/resolve can find the declaration again.
+type completionData struct {
+	URI    lsp.DocumentURI `json:"uri"`
+	Offset int             `json:"offset"`
+	File   string          `json:"file,omitempty"`
+	Name   string          `json:"name"`
+	Import string          `json:"import,omitempty"`
+}
+
+func withTier(items []CompletionItem, tier int) []CompletionItem {
+	for i := range items {
+		items[i].tier = tier
+	}
+	return items
+}
+
+// symbolCompletions offers the variables, functions and classes visible from
+// offset. Class members are left out since they are reached through `this.`.
+func symbolCompletions(uri lsp.DocumentURI, sc *Scope, offset int) []CompletionItem {
+	items := []CompletionItem{}
+	for _, b := range sc.Visible(offset) {
+		var kind lsp.CompletionItemKind
+		switch b.Kind {
+		case "variable":
+			kind = lsp.CIKVariable
+			if b.Constant {
+				kind = lsp.CIKConstant
+			}
+		case "parameter":
+			kind = lsp.CIKVariable
+		case "function", "extern":
+			kind = lsp.CIKFunction
+		case "class":
+			kind = lsp.CIKClass
+		default:
+			continue
+		}
+
+		tier := tierGlobal
+		if b.Scope.isLocal() {
+			tier = tierLocal
+		}
+		items = append(items, CompletionItem{
+			CompletionItem: lsp.CompletionItem{Label: b.Name, Kind: kind, Detail: b.Type},
+			Data:           &completionData{URI: uri, Offset: offset, Name: b.Name},
+			tier:           tier,
+		})
+	}
+	return items
+}
+
+// importedCompletions offers the symbols the document's imports bring in.
+func (s *Server) importedCompletions(uri lsp.DocumentURI, prog *Program) []CompletionItem {
+	items := []CompletionItem{}
+	for _, sym := range s.importedSymbols(uriToPath(uri), prog) {
+		kind := lsp.CIKFunction
+		if sym.Type == "class" {
+			kind = lsp.CIKClass
+		}
+		items = append(items, CompletionItem{
+			CompletionItem: lsp.CompletionItem{Label: sym.Name, Kind: kind, Detail: sym.Type},
+			Data:           &completionData{URI: uri, File: sym.Data["file"], Name: sym.Data["symbol"]},
+			tier:           tierImported,
+		})
+	}
+	return items
+}
+
+// fuzzyScore matches pattern against candidate. The first character has to
+// match the start of the candidate, the rest may be spread over it in order.
+// Higher scores mean better matches: consecutive runs, word boundaries,
+// matching case and short candidates all count.
+func fuzzyScore(pattern, candidate string) (int, bool) {
+	if pattern == "" {
+		return 0, true
+	}
+	p, c := []rune(pattern), []rune(candidate)
+	if len(c) == 0 || unicode.ToLower(c[0]) != unicode.ToLower(p[0]) {
+		return 0, false
+	}
+
+	score, j, last := 0, 0, -2
+	for i := 0; i < len(c) && j < len(p); i++ {
+		if unicode.ToLower(c[i]) != unicode.ToLower(p[j]) {
+			continue
+		}
+		score += 10
+		if last == i-1 {
+			score += 5
+		}
+		if c[i] == p[j] {
+			score++
+		}
+		if i > 0 && (c[i-1] == '_' || c[i-1] == '/' || (unicode.IsUpper(c[i]) && unicode.IsLower(c[i-1]))) {
+			score += 8
+		}
+		last = i
+		j++
+	}
+	if j < len(p) {
+		return 0, false
+	}
+
+	if strings.HasPrefix(strings.ToLower(candidate), strings.ToLower(pattern)) {
+		score += 20
+	}
+	return score - (len(c) - len(p)), true
+}
+
+// rankCompletions filters items against the word before the cursor and gives
+// them a stable order: recently accepted items first, then by tier, match
+// score and label. Items without an edit get one replacing the typed word.
+func (s *Server) rankCompletions(items []CompletionItem, text string, pos lsp.Position) []CompletionItem {
+	word := text[len(strings.TrimRightFunc(text, isIdentRune)):]
+	rng := lsp.Range{Start: lsp.Position{Line: pos.Line, Character: pos.Character - encodedLen(word)}, End: pos}
+
+	recency := make(map[string]int)
+	for i, label := range s.recent {
+		recency[label] = i
+	}
+
+	ranked := []CompletionItem{}
+	for _, item := range items {
+		filter := item.FilterText
+		if filter == "" {
+			filter = item.Label
+		}
+		typed := word
+		if item.TextEdit != nil && item.TextEdit.Range.Start.Line == pos.Line && item.TextEdit.Range.Start.Character <= encodedLen(text) {
+			typed = text[byteColumn(text, item.TextEdit.Range.Start.Character):]
+		}
+		score, ok := fuzzyScore(typed, filter)
+		if !ok {
+			continue
+		}
+
+		if item.TextEdit == nil {
+			newText := item.InsertText
+			if newText == "" {
+				newText = item.Label
+			}
+			item.TextEdit = &lsp.TextEdit{Range: rng, NewText: newText}
+		}
+		recent, ok := recency[item.Label]
+		if !ok {
+			recent = maxRecent
+		}
+		item.FilterText = filter
+		item.SortText = fmt.Sprintf("%02d%d%04d%s", recent, item.tier, 5000-score, item.Label)
+		item.Command = &lsp.Command{Title: "", Command: CompletionAcceptedCommand, Arguments: []interface{}{item.Label}}
+		ranked = append(ranked, item)
+	}
+
+	sort.SliceStable(ranked, func(i, j int) bool {
+		return ranked[i].SortText < ranked[j].SortText
+	})
+	return ranked
+}
+
+// CompletionAccepted records that the item with the given label was picked.
+func (s *Server) CompletionAccepted(label string) {
+	recent := []string{label}
+	for _, l := range s.recent {
+		if l != label && len(recent) < maxRecent {
+			recent = append(recent, l)
+		}
+	}
+	s.recent = recent
+}
+
+// ResolveCompletion fills in the full signature and documentation of the
+// declaration behind a completion item.
+func (s *Server) ResolveCompletion(ctx context.Context, item CompletionItem) (CompletionItem, error) {
+	data := item.Data
+	if data == nil {
+		return item, nil
+	}
+
+	var b *Binding
+	if data.File != "" {
+		sc, err := s.scopesOf(data.File)
+		if err != nil {
+			return item, nil
+		}
+		b = sc.Lookup(data.Name, 0)
+	} else if prog := s.asts[string(data.URI)]; prog != nil {
+		b = BuildScopes(prog).Lookup(data.Name, data.Offset)
+	}
+	if b == nil {
+		return item, nil
+	}
+
+	signature := bindingSignature(b)
+	item.Detail = signature
+	if data.Import != "" {
+		item.Detail += fmt.Sprintf(" (import \"%s\")", data.Import)
+	}
+	item.Documentation = MarkupContent{Kind: "markdown", Value: s.declarationMarkdown(b, signature, uriToPath(data.URI))}
+	return item, nil
+}
+
+// bindingSignature renders the declaration a binding comes from.
+func bindingSignature(b *Binding) string {
+	var prefix string
+	if b.Exported {
+		prefix = "export "
+	}
+	if b.Private {
+		prefix += "private "
+	}
+	if b.Static {
+		prefix += "static "
+	}
+
+	switch node := b.Node.(type) {
+	case *VariableDefinition:
+		if b.Constant {
+			prefix += "const "
+		}
+		return prefix + "var " + b.Name + ": " + b.Type
+	case *FieldDefinition, *ArgumentDefinition:
+		return prefix + b.Name + ": " + b.Type
+	case *FunctionDefinition:
+		signature := prefix + "func " + b.Name + "(" + formatParameters(node.Parameters) + ")"
+		if b.Type != "" {
+			signature += ": " + b.Type
+		}
+		return signature
+	case *ExternalFunctionDefinition:
+		signature := prefix + "extern func " + b.Name + "(" + formatParameters(node.Parameters) + ")"
+		if b.Type != "" {
+			signature += ": " + b.Type
+		}
+		return signature
+	case *ClassDefinition:
+		return prefix + "class " + b.Name
+	}
+	return b.Name
+}
@@ -0,0 +1,895 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/alecthomas/participle/v2/lexer"
+	"github.com/vyPal/go-lsp"
+)
+
+// childBodies returns the statement lists nested directly inside stmt.
+func childBodies(stmt *Statement) [][]*Statement {
+	switch {
+	case stmt.Export != nil:
+		return [][]*Statement{{stmt.Export}}
+	case stmt.FunctionDefinition != nil:
+		return [][]*Statement{stmt.FunctionDefinition.Body}
+	case stmt.ClassDefinition != nil:
+		return [][]*Statement{stmt.ClassDefinition.Body}
+	case stmt.If != nil:
+		bodies := [][]*Statement{stmt.If.Body}
+		for _, e := range stmt.If.ElseIf {
+			bodies = append(bodies, e.Body)
+		}
+		return append(bodies, stmt.If.Else)
+	case stmt.For != nil:
+		return [][]*Statement{stmt.For.Body}
+	case stmt.While != nil:
+		return [][]*Statement{stmt.While.Body}
+	}
+	return nil
+}
+
+func statementEnd(stmt *Statement) int {
+	return tokensEnd(stmt.Tokens)
+}
+
+// selectedStatements returns the run of sibling statements that lies
+// completely inside [start, end). It returns nil if the selection cuts through
+// a statement.
+func selectedStatements(stmts []*Statement, start, end int) []*Statement {
+	var run []*Statement
+	for _, stmt := range stmts {
+		s, e := stmt.Pos.Offset, statementEnd(stmt)
+		if e <= start || s >= end {
+			continue
+		}
+		if s >= start && e <= end {
+			run = append(run, stmt)
+			continue
+		}
+		if len(run) == 0 && s <= start && end <= e {
+			for _, body := range childBodies(stmt) {
+				if inner := selectedStatements(body, start, end); inner != nil {
+					return inner
+				}
+			}
+		}
+		return nil
+	}
+	return run
+}
+
+// anchorStatement returns the innermost statement containing offset together
+// with the statement list it belongs to.
+func anchorStatement(stmts []*Statement, offset int) (*Statement, []*Statement) {
+	for _, stmt := range stmts {
+		if offset < stmt.Pos.Offset || offset >= statementEnd(stmt) {
+			continue
+		}
+		for _, body := range childBodies(stmt) {
+			if inner, list := anchorStatement(body, offset); inner != nil {
+				return inner, list
+			}
+		}
+		return stmt, stmts
+	}
+	return nil, nil
+}
+
+// lineIndent returns the whitespace at the start of the line containing offset.
+func lineIndent(doc string, offset int) string {
+	start := strings.LastIndexByte(doc[:offset], '\n') + 1
+	line := doc[start:]
+	return line[:len(line)-len(strings.TrimLeft(line, " \t"))]
+}
+
+// reindent moves a block of lines from one indentation level to another.
+func reindent(text, from, to string) string {
+	lines := strings.Split(text, "\n")
+	for i, line := range lines {
+		if strings.TrimSpace(line) == "" {
+			lines[i] = ""
+			continue
+		}
+		lines[i] = to + strings.TrimPrefix(line, from)
+	}
+	return strings.Join(lines, "\n")
+}
+
+// uniqueName returns base, or base followed by a number, such that the name
+// does not resolve to anything at the given offsets.
+func uniqueName(sc *Scope, base string, offsets ...int) string {
+	for i := 0; ; i++ {
+		name := base
+		if i > 0 {
+			name += strconv.Itoa(i)
+		}
+		taken := false
+		for _, offset := range offsets {
+			if sc.Lookup(name, offset) != nil {
+				taken = true
+				break
+			}
+		}
+		if !taken {
+			return name
+		}
+	}
+}
+
+type nameUse struct {
+	name   string
+	offset int
+	write  bool
+}
+
+// nameUses lists the root names referenced by stmts in source order: plain
+// identifiers, method receivers and the targets of assignments.
+func nameUses(stmts []*Statement) []nameUse {
+	var uses []nameUse
+	forEachStatement(stmts, func(stmt *Statement) {
+		if stmt.Assignment != nil {
+			uses = append(uses, nameUse{stmt.Assignment.Left.Name, stmt.Assignment.Left.Pos.Offset, stmt.Assignment.Left.Sub == nil})
+		}
+	})
+	forEachFactor(stmts, func(fact *Factor) {
+		if fact.Identifier != nil {
+			uses = append(uses, nameUse{fact.Identifier.Name, fact.Identifier.Pos.Offset, false})
+		} else if fact.ClassMethod != nil {
+			uses = append(uses, nameUse{fact.ClassMethod.Identifier.Name, fact.ClassMethod.Identifier.Pos.Offset, false})
+		}
+	})
+	return uses
+}
+
+// escapesLoop reports whether stmts contain a break or continue that is not
+// enclosed by a loop inside stmts.
+func escapesLoop(stmts []*Statement) bool {
+	for _, stmt := range stmts {
+		switch {
+		case stmt.Break != nil, stmt.Continue != nil:
+			return true
+		case stmt.If != nil:
+			if escapesLoop(stmt.If.Body) || escapesLoop(stmt.If.Else) {
+				return true
+			}
+			for _, e := range stmt.If.ElseIf {
+				if escapesLoop(e.Body) {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+func (s *Server) extractActions(uri lsp.DocumentURI, doc string, prog *Program, rng lsp.Range) []CodeAction {
+	actions := []CodeAction{}
+	if comparePositions(rng.Start, rng.End) == 0 {
+		return actions
+	}
+
+	start, end := positionToOffset(doc, rng.Start), positionToOffset(doc, rng.End)
+	text := doc[start:end]
+	start += len(text) - len(strings.TrimLeft(text, " \t\r\n"))
+	end -= len(text) - len(strings.TrimRight(text, " \t\r\n"))
+	if start >= end {
+		return actions
+	}
+
+	sc := BuildScopes(prog)
+	if action := extractFunction(uri, doc, prog, sc, start, end); action != nil {
+		actions = append(actions, *action)
+	}
+	actions = append(actions, extractVariable(uri, doc, prog, sc, start, end)...)
+	return actions
+}
+
+// extractFunction moves the statements in [start, end) into a new function
+// placed after the enclosing one. Variables of the enclosing function become
+// parameters; a single variable that is declared or reassigned by the
+// statements and used afterwards becomes the return value.
+func extractFunction(uri lsp.DocumentURI, doc string, prog *Program, sc *Scope, start, end int) *CodeAction {
+	run := selectedStatements(prog.Statements, start, end)
+	if len(run) == 0 || escapesLoop(run) {
+		return nil
+	}
+	runStart, runEnd := run[0].Pos.Offset, statementEnd(run[len(run)-1])
+
+	fd := sc.EnclosingFunction(runStart)
+	if fd == nil {
+		return nil
+	}
+	fnScope := sc.Innermost(runStart)
+	for fnScope.Parent != nil && fnScope.Parent.Function == fd {
+		fnScope = fnScope.Parent
+	}
+
+	// Locals declared before the selection are passed in as parameters.
+	var params []*Binding
+	var assigned []*Binding
+	seen := make(map[*Binding]bool)
+	for _, use := range nameUses(run) {
+		b := sc.Lookup(use.name, use.offset)
+		if b == nil || !b.Scope.isLocal() || b.Pos.Offset >= runStart {
+			continue
+		}
+		if !seen[b] {
+			seen[b] = true
+			params = append(params, b)
+		}
+		if use.write && !containsBinding(assigned, b) {
+			assigned = append(assigned, b)
+		}
+	}
+
+	// Variables the selection declares or reassigns and the rest of the
+	// function still reads have to come back out as the return value.
+	var results []*Binding
+	declared := make(map[*Binding]bool)
+	for _, stmt := range run {
+		if stmt.VariableDefinition != nil {
+			declared[sc.Lookup(stmt.VariableDefinition.Name.Value, stmt.Pos.Offset)] = true
+		}
+	}
+	for _, use := range nameUses(fd.Body) {
+		if use.offset < runEnd {
+			continue
+		}
+		b := sc.Lookup(use.name, use.offset)
+		if b != nil && (declared[b] || containsBinding(assigned, b)) && !containsBinding(results, b) {
+			results = append(results, b)
+		}
+	}
+
+	hasReturn := false
+	forEachStatement(run, func(stmt *Statement) {
+		if stmt.Return != nil {
+			hasReturn = true
+		}
+	})
+
+	var returnType, call, tail string
+	switch {
+	case hasReturn:
+		// Only a trailing return can be moved, the caller returns its result.
+		last := run[len(run)-1]
+		if len(results) > 0 || last.Return == nil {
+			return nil
+		}
+		nested := false
+		forEachStatement(run[:len(run)-1], func(stmt *Statement) {
+			nested = nested || stmt.Return != nil
+		})
+		if nested {
+			return nil
+		}
+		if fd.ReturnType.Value == "" || fd.ReturnType.Value == "void" {
+			// A void function has no result to return, it returns after the call.
+			call = "%s;\n" + lineIndent(doc, runStart) + "return;"
+		} else {
+			returnType = fd.ReturnType.Value
+			call = "return %s;"
+		}
+	case len(results) > 1:
+		return nil
+	case len(results) == 1:
+		r := results[0]
+		returnType = r.Type
+		tail = "return " + r.Name + ";"
+		if declared[r] {
+			call = "var " + r.Name + ": " + r.Type + " = %s;"
+		} else {
+			call = r.Name + " = %s;"
+		}
+	default:
+		call = "%s;"
+	}
+
+	class := sc.EnclosingClass(runStart)
+	offsets := []int{runStart}
+	name := "extracted"
+	if class != nil {
+		for i := 0; sc.ClassScope(class.Name.Value).Member(name) != nil; i++ {
+			name = "extracted" + strconv.Itoa(i+1)
+		}
+	} else {
+		name = uniqueName(sc, name, offsets...)
+	}
+
+	var paramDefs, args []string
+	for _, p := range params {
+		paramDefs = append(paramDefs, p.Name+": "+p.Type)
+		args = append(args, p.Name)
+	}
+
+	fnStart := fnScope.Parent.Start
+	for _, b := range fnScope.Parent.Bindings {
+		if b.Node == fd {
+			fnStart = b.Pos.Offset
+		}
+	}
+	fnIndent := lineIndent(doc, fnStart)
+	unit := "\t"
+	if len(fd.Body) > 0 {
+		if bodyIndent := lineIndent(doc, fd.Body[0].Pos.Offset); strings.HasPrefix(bodyIndent, fnIndent) && len(bodyIndent) > len(fnIndent) {
+			unit = bodyIndent[len(fnIndent):]
+		}
+	}
+
+	body := reindent(lineIndent(doc, runStart)+doc[runStart:runEnd], lineIndent(doc, runStart), fnIndent+unit)
+	if tail != "" {
+		body += "\n" + fnIndent + unit + tail
+	}
+
+	var def strings.Builder
+	def.WriteString("\n\n" + fnIndent)
+	if class != nil {
+		def.WriteString("private ")
+		if fd.Static {
+			def.WriteString("static ")
+		}
+	}
+	def.WriteString("func " + name + "(" + strings.Join(paramDefs, ", ") + ")")
+	if returnType != "" {
+		def.WriteString(": " + returnType)
+	}
+	def.WriteString(" {\n" + body + "\n" + fnIndent + "}")
+
+	// Static methods have no this, they call the helper through the class.
+	callee := name
+	if class != nil && fd.Static {
+		callee = class.Name.Value + "." + name
+	} else if class != nil {
+		callee = "this." + name
+	}
+
+	return &CodeAction{
+		Title: "Extract to function",
+		Kind:  lsp.CAKRefactorExtract,
+		Edit: singleEdit(uri,
+			lsp.TextEdit{Range: offsetRange(doc, runStart, runEnd), NewText: fmt.Sprintf(call, callee+"("+strings.Join(args, ", ")+")")},
+			lsp.TextEdit{Range: offsetRange(doc, fnScope.End, fnScope.End), NewText: def.String()},
+		),
+		sources: []Node{fd},
+	}
+}
+
+func containsBinding(list []*Binding, b *Binding) bool {
+	for _, l := range list {
+		if l == b {
+			return true
+		}
+	}
+	return false
+}
+
+// expressionNode is an Expression or Factor together with its tokens, the
+// two node kinds a selection can be extracted from.
+type expressionNode struct {
+	tokens []lexer.Token
+	expr   *Expression
+	fact   *Factor
+}
+
+func (n expressionNode) start() int { return n.tokens[0].Pos.Offset }
+func (n expressionNode) end() int   { return tokensEnd(n.tokens) }
+
+func (n expressionNode) key() string {
+	var values []string
+	for _, t := range n.tokens {
+		values = append(values, t.Value)
+	}
+	return strings.Join(values, " ")
+}
+
+// expressionNodes lists every expression and factor inside stmts in source
+// order, outer nodes before the nodes they contain.
+func expressionNodes(stmts []*Statement) []expressionNode {
+	var nodes []expressionNode
+	for _, stmt := range stmts {
+		if stmt == nil {
+			continue
+		}
+		Inspect(stmt, func(n Node) bool {
+			switch n := n.(type) {
+			case *Expression:
+				if len(n.Tokens) > 0 {
+					nodes = append(nodes, expressionNode{tokens: n.Tokens, expr: n})
+				}
+			case *Factor:
+				if len(n.Tokens) > 0 {
+					nodes = append(nodes, expressionNode{tokens: n.Tokens, fact: n})
+				}
+			}
+			return true
+		})
+	}
+	return nodes
+}
+
+// extractVariable declares the expression in [start, end) as a variable in
+// front of the statement using it. A second action also replaces identical
+// expressions in the statements that follow.
+func extractVariable(uri lsp.DocumentURI, doc string, prog *Program, sc *Scope, start, end int) []CodeAction {
+	anchor, list := anchorStatement(prog.Statements, start)
+	if anchor == nil {
+		return nil
+	}
+
+	var selected *expressionNode
+	for _, n := range expressionNodes([]*Statement{anchor}) {
+		if n.start() == start && n.end() == end {
+			selected = &n
+			break
+		}
+	}
+	if selected == nil {
+		return nil
+	}
+
+	// Loop conditions are evaluated on every iteration, hoisting them would
+	// change what the loop does. Else-if conditions only run when the
+	// branches before them were not taken, in front of the if they would
+	// always run.
+	switch {
+	case anchor.For != nil || anchor.While != nil:
+		spans := braceSpans(anchor.Tokens)
+		if len(spans) == 0 || start < spans[0][0] {
+			return nil
+		}
+	case anchor.If != nil:
+		if _, condEnd := nodeOffsets(anchor.If.Condition); start >= condEnd {
+			return nil
+		}
+	}
+
+	var typ string
+	if selected.expr != nil {
+		typ = sc.ExpressionType(selected.expr, start)
+	} else {
+		typ = sc.FactorType(selected.fact, start)
+	}
+	if typ == "" || typ == "void" {
+		return nil
+	}
+
+	var following []*Statement
+	for i, stmt := range list {
+		if stmt == anchor {
+			following = list[i:]
+		}
+	}
+	// Later occurrences only have the same value while the names read by the
+	// selection keep theirs. Collection stops after the first assignment to
+	// one of them, before a later loop assigning one, as its occurrences see
+	// the new value on the next iteration, and at the first occurrence where a
+	// name resolves to a different binding.
+	uses := nameUses(following)
+	free := make(map[string]*Binding)
+	for _, use := range uses {
+		if use.offset >= start && use.offset < end {
+			free[use.name] = sc.Lookup(use.name, use.offset)
+		}
+	}
+	var writes []*Statement
+	forEachStatement(following, func(stmt *Statement) {
+		if stmt.Assignment == nil {
+			return
+		}
+		if _, ok := free[stmt.Assignment.Left.Name]; ok {
+			writes = append(writes, stmt)
+		}
+	})
+	limit := statementEnd(following[len(following)-1])
+	for _, w := range writes {
+		if statementEnd(w) < limit {
+			limit = statementEnd(w)
+		}
+	}
+	forEachStatement(following, func(stmt *Statement) {
+		if (stmt.For == nil && stmt.While == nil) || stmt.Pos.Offset < start || stmt.Pos.Offset >= limit {
+			return
+		}
+		for _, w := range writes {
+			if w.Pos.Offset >= stmt.Pos.Offset && statementEnd(w) <= statementEnd(stmt) {
+				limit = stmt.Pos.Offset
+				return
+			}
+		}
+	})
+	sameBindings := func(n expressionNode) bool {
+		for _, use := range uses {
+			if use.offset >= n.start() && use.offset < n.end() && sc.Lookup(use.name, use.offset) != free[use.name] {
+				return false
+			}
+		}
+		return true
+	}
+
+	var occurrences []expressionNode
+	last := -1
+	for _, n := range expressionNodes(following) {
+		if n.start() >= limit {
+			break
+		}
+		if n.key() != selected.key() || n.start() < last || n.end() > limit {
+			continue
+		}
+		if !sameBindings(n) {
+			break
+		}
+		occurrences = append(occurrences, n)
+		last = n.end()
+	}
+
+	offsets := []int{anchor.Pos.Offset}
+	for _, n := range occurrences {
+		offsets = append(offsets, n.start())
+	}
+	name := uniqueName(sc, "value", offsets...)
+	decl := "var " + name + ": " + typ + " = " + doc[start:end] + ";\n" + lineIndent(doc, anchor.Pos.Offset)
+
+	build := func(nodes []expressionNode) *lsp.WorkspaceEdit {
+		edits := []lsp.TextEdit{}
+		declared := false
+		for _, n := range nodes {
+			newText := name
+			if n.start() == anchor.Pos.Offset {
+				newText = decl + name
+				declared = true
+			}
+			edits = append(edits, lsp.TextEdit{Range: offsetRange(doc, n.start(), n.end()), NewText: newText})
+		}
+		if !declared {
+			edits = append([]lsp.TextEdit{{Range: offsetRange(doc, anchor.Pos.Offset, anchor.Pos.Offset), NewText: decl}}, edits...)
+		}
+		return singleEdit(uri, edits...)
+	}
+
+	var sources []Node
+	for _, stmt := range following {
+		sources = append(sources, stmt)
+	}
+	actions := []CodeAction{{
+		Title:   "Extract to variable",
+		Kind:    lsp.CAKRefactorExtract,
+		Edit:    build([]expressionNode{*selected}),
+		sources: []Node{anchor},
+	}}
+	if len(occurrences) > 1 {
+		actions = append(actions, CodeAction{
+			Title:   fmt.Sprintf("Extract to variable (replace all %d occurrences)", len(occurrences)),
+			Kind:    lsp.CAKRefactorExtract,
+			Edit:    build(occurrences),
+			sources: sources,
+		})
+	}
+	return actions
+}
+
+// lineRange widens [from, to) to the whole line, newline included, when the
+// text in between is the only thing on it.
+func lineRange(doc string, from, to int) (int, int) {
+	lineStart := strings.LastIndexByte(doc[:from], '\n') + 1
+	if strings.TrimSpace(doc[lineStart:from]) == "" && strings.HasPrefix(strings.TrimLeft(doc[to:], " \t"), "\n") {
+		return lineStart, to + len(doc[to:]) - len(strings.TrimLeft(doc[to:], " \t")) + 1
+	}
+	return from, to
+}
+
+// isCompound reports whether an expression contains a binary operator and so
+// needs parentheses when substituted into another expression.
+func isCompound(expr *Expression) bool {
+	return len(expr.Right) > 0 || len(expr.Left.Right) > 0 || len(expr.Left.Left.Right) > 0
+}
+
+// sideEffectFree reports whether evaluating expr cannot call functions or
+// allocate, so that it may be evaluated any number of times.
+func sideEffectFree(expr *Expression) bool {
+	free := true
+	forEachFactorInExpression(expr, func(fact *Factor) {
+		if fact.FunctionCall != nil || fact.ClassMethod != nil || fact.ClassInitializer != nil {
+			free = false
+		}
+	})
+	return free
+}
+
+// expressionNames lists the names expr resolves in its scope: identifiers,
+// method receivers and called functions.
+func expressionNames(expr *Expression) []nameUse {
+	var uses []nameUse
+	forEachFactorInExpression(expr, func(fact *Factor) {
+		switch {
+		case fact.Identifier != nil:
+			uses = append(uses, nameUse{fact.Identifier.Name, fact.Pos.Offset, false})
+		case fact.ClassMethod != nil:
+			uses = append(uses, nameUse{fact.ClassMethod.Identifier.Name, fact.Pos.Offset, false})
+		case fact.FunctionCall != nil:
+			uses = append(uses, nameUse{strings.Trim(fact.FunctionCall.FunctionName, "\""), fact.Pos.Offset, false})
+		}
+	})
+	return uses
+}
+
+// resolvesAlike reports whether every name in uses, apart from the skipped
+// bindings, means the same at offset as where it is written. Moving text whose
+// names would be captured by other declarations changes what it refers to.
+func resolvesAlike(sc *Scope, uses []nameUse, offset int, skip map[*Binding]int) bool {
+	for _, use := range uses {
+		b := sc.Lookup(use.name, use.offset)
+		if _, skipped := skip[b]; skipped && b != nil {
+			continue
+		}
+		if sc.Lookup(use.name, offset) != b {
+			return false
+		}
+	}
+	return true
+}
+
+func expressionText(doc string, expr *Expression) string {
+	text := doc[expr.Tokens[0].Pos.Offset:tokensEnd(expr.Tokens)]
+	if isCompound(expr) {
+		return "(" + text + ")"
+	}
+	return text
+}
+
+func isPlainIdentifier(expr *Expression) bool {
+	if isCompound(expr) {
+		return false
+	}
+	iden := expr.Left.Left.Left.Identifier
+	return iden != nil && iden.Ref == "" && iden.Deref == "" && iden.Sub == nil && iden.GEP == nil
+}
+
+// declaringStatement returns the statement that declares node, which is the
+// export statement itself for exported declarations.
+func declaringStatement(prog *Program, node interface{}) *Statement {
+	var found *Statement
+	forEachStatement(prog.Statements, func(stmt *Statement) {
+		decl := stmt
+		if decl.Export != nil {
+			decl = decl.Export
+		}
+		if found == nil && ((decl.VariableDefinition != nil && node == decl.VariableDefinition) ||
+			(decl.FunctionDefinition != nil && node == decl.FunctionDefinition)) {
+			found = stmt
+		}
+	})
+	return found
+}
+
+func (s *Server) inlineActions(uri lsp.DocumentURI, doc string, prog *Program, rng lsp.Range) []CodeAction {
+	actions := []CodeAction{}
+	offset := positionToOffset(doc, rng.Start)
+	sc := BuildScopes(prog)
+
+	b, fact := bindingAt(prog, sc, offset)
+	if b == nil || b.Exported {
+		return actions
+	}
+
+	switch b.Kind {
+	case "variable":
+		if action := inlineConstant(uri, doc, prog, sc, b); action != nil {
+			actions = append(actions, *action)
+		}
+	case "function":
+		actions = append(actions, inlineFunction(uri, doc, prog, sc, b, fact)...)
+	}
+	return actions
+}
+
+// inlineConstant replaces every use of a side effect free `const var` with
+// its initializer and removes the declaration.
+func inlineConstant(uri lsp.DocumentURI, doc string, prog *Program, sc *Scope, b *Binding) *CodeAction {
+	vd := b.Node.(*VariableDefinition)
+	if !b.Constant || vd.Assignment == nil || !sideEffectFree(vd.Assignment) {
+		return nil
+	}
+
+	value := expressionText(doc, vd.Assignment)
+	names := expressionNames(vd.Assignment)
+	edits := []lsp.TextEdit{}
+	usable := true
+
+	forEachStatement(prog.Statements, func(stmt *Statement) {
+		if stmt.Assignment != nil && sc.Lookup(stmt.Assignment.Left.Name, stmt.Pos.Offset) == b {
+			usable = false
+		}
+	})
+	forEachFactor(prog.Statements, func(fact *Factor) {
+		var iden *Identifier
+		if fact.Identifier != nil {
+			iden = fact.Identifier
+		} else if fact.ClassMethod != nil {
+			iden = fact.ClassMethod.Identifier
+		}
+		if iden == nil || sc.Lookup(iden.Name, fact.Pos.Offset) != b {
+			return
+		}
+		if fact.Identifier == nil || iden.Ref != "" || iden.Deref != "" || iden.Sub != nil || iden.GEP != nil {
+			// Only plain reads can be replaced by a value.
+			usable = false
+			return
+		}
+		if !resolvesAlike(sc, names, fact.Pos.Offset, nil) {
+			usable = false
+			return
+		}
+		edits = append(edits, lsp.TextEdit{Range: offsetRange(doc, fact.Pos.Offset, tokensEnd(fact.Tokens)), NewText: value})
+	})
+
+	decl := declaringStatement(prog, vd)
+	if !usable || decl == nil {
+		return nil
+	}
+	from, to := lineRange(doc, decl.Pos.Offset, statementEnd(decl))
+	edits = append(edits, lsp.TextEdit{Range: offsetRange(doc, from, to)})
+
+	return &CodeAction{
+		Title: fmt.Sprintf("Inline constant '%s'", b.Name),
+		Kind:  lsp.CAKRefactorInline,
+		Edit:  singleEdit(uri, edits...),
+	}
+}
+
+// inlinedCall returns the body of a single-expression function with the
+// arguments of call substituted for its parameters. It reports false when the
+// substitution would change what the program does.
+func inlinedCall(doc string, sc *Scope, fd *FunctionDefinition, call *FunctionCall) (string, bool) {
+	body := fd.Body[0].Return.Expression
+	args := call.Args.Arguments
+	if len(args) != len(fd.Parameters) {
+		return "", false
+	}
+
+	params := make(map[*Binding]int)
+	for i, p := range fd.Parameters {
+		params[sc.Lookup(p.Name.Value, body.Pos.Offset)] = i
+	}
+
+	type replacement struct {
+		start, end int
+		text       string
+	}
+	var replacements []replacement
+	uses := make([]int, len(args))
+	ok := true
+
+	forEachFactorInExpression(body, func(fact *Factor) {
+		var iden *Identifier
+		if fact.Identifier != nil {
+			iden = fact.Identifier
+		} else if fact.ClassMethod != nil {
+			iden = fact.ClassMethod.Identifier
+		}
+		if iden == nil {
+			return
+		}
+		i, isParam := params[sc.Lookup(iden.Name, fact.Pos.Offset)]
+		if !isParam {
+			return
+		}
+		uses[i]++
+
+		t, _ := nameToken(fact.Tokens, iden.Name)
+		if fact.Identifier != nil && iden.Ref == "" && iden.Deref == "" && iden.Sub == nil && iden.GEP == nil {
+			replacements = append(replacements, replacement{t.Pos.Offset, t.Pos.Offset + len(t.Value), expressionText(doc, args[i])})
+		} else if isPlainIdentifier(args[i]) {
+			// p.x or *p can only take another name, not an arbitrary value.
+			replacements = append(replacements, replacement{t.Pos.Offset, t.Pos.Offset + len(t.Value), expressionText(doc, args[i])})
+		} else {
+			ok = false
+		}
+	})
+
+	for i, n := range uses {
+		if n != 1 && !sideEffectFree(args[i]) {
+			ok = false
+		}
+	}
+	if !ok || !resolvesAlike(sc, expressionNames(body), call.Pos.Offset, params) {
+		return "", false
+	}
+
+	start, end := body.Tokens[0].Pos.Offset, tokensEnd(body.Tokens)
+	var text strings.Builder
+	for _, r := range replacements {
+		text.WriteString(doc[start:r.start])
+		text.WriteString(r.text)
+		start = r.end
+	}
+	text.WriteString(doc[start:end])
+
+	if isCompound(body) {
+		return "(" + text.String() + ")", true
+	}
+	return text.String(), true
+}
+
+// inlineFunction replaces calls of a function whose body is a single return
+// statement with the returned expression. Exported, recursive and extern
+// backed functions are left alone.
+func inlineFunction(uri lsp.DocumentURI, doc string, prog *Program, sc *Scope, b *Binding, at *Factor) []CodeAction {
+	fd := b.Node.(*FunctionDefinition)
+	if fd.Variadic || len(fd.Body) != 1 || fd.Body[0].Return == nil || fd.Body[0].Return.Expression == nil {
+		return nil
+	}
+
+	recursive := false
+	forEachFactor(fd.Body, func(fact *Factor) {
+		if fact.FunctionCall != nil && strings.Trim(fact.FunctionCall.FunctionName, "\"") == b.Name {
+			recursive = true
+		}
+	})
+	if recursive {
+		return nil
+	}
+	for _, other := range sc.root().Bindings {
+		if other.Kind == "extern" && other.Name == b.Name {
+			return nil
+		}
+	}
+
+	var actions []CodeAction
+	if at != nil && at.FunctionCall != nil {
+		if text, ok := inlinedCall(doc, sc, fd, at.FunctionCall); ok {
+			actions = append(actions, CodeAction{
+				Title:   fmt.Sprintf("Inline call to '%s'", b.Name),
+				Kind:    lsp.CAKRefactorInline,
+				Edit:    singleEdit(uri, lsp.TextEdit{Range: offsetRange(doc, at.Pos.Offset, tokensEnd(at.Tokens)), NewText: text}),
+				sources: []Node{fd},
+			})
+		}
+	}
+
+	// The declaration can only go once every reference to it is a call that
+	// gets inlined.
+	edits := []lsp.TextEdit{}
+	usable := true
+	forEachFactor(prog.Statements, func(fact *Factor) {
+		var iden *Identifier
+		if fact.Identifier != nil {
+			iden = fact.Identifier
+		} else if fact.ClassMethod != nil {
+			iden = fact.ClassMethod.Identifier
+		}
+		if iden != nil && sc.Lookup(iden.Name, fact.Pos.Offset) == b {
+			usable = false
+		}
+		if fact.FunctionCall == nil || sc.Lookup(strings.Trim(fact.FunctionCall.FunctionName, "\""), fact.Pos.Offset) != b {
+			return
+		}
+		text, ok := inlinedCall(doc, sc, fd, fact.FunctionCall)
+		if !ok {
+			usable = false
+			return
+		}
+		edits = append(edits, lsp.TextEdit{Range: offsetRange(doc, fact.Pos.Offset, tokensEnd(fact.Tokens)), NewText: text})
+	})
+
+	decl := declaringStatement(prog, fd)
+	if !usable || decl == nil {
+		return actions
+	}
+	from, to := lineRange(doc, decl.Pos.Offset, statementEnd(decl))
+	// The blank line separating the declaration from what follows goes with
+	// it when one also precedes it.
+	if rest := strings.TrimLeft(doc[to:], " \t"); strings.HasPrefix(rest, "\n") && strings.HasSuffix(doc[:from], "\n\n") {
+		to = len(doc) - len(rest) + 1
+	}
+	edits = append(edits, lsp.TextEdit{Range: offsetRange(doc, from, to)})
+
+	return append(actions, CodeAction{
+		Title: fmt.Sprintf("Inline function '%s'", b.Name),
+		Kind:  lsp.CAKRefactorInline,
+		Edit:  singleEdit(uri, edits...),
+	})
+}
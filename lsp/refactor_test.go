@@ -0,0 +1,300 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/vyPal/go-lsp"
+)
+
+func TestExtractFunctionInStaticMethod(t *testing.T) {
+	src := `package main;
+
+class P {
+	static func make(n: i32): i32 {
+		var a: i32 = n + 1;
+		print(a);
+		return a;
+	}
+}
+`
+	want := `package main;
+
+class P {
+	static func make(n: i32): i32 {
+		var a: i32 = n + 1;
+		P.extracted(a);
+		return a;
+	}
+
+	private static func extracted(a: i32) {
+		print(a);
+	}
+}
+`
+	s, dir := newTestServer(t, map[string]string{"main.cffc": src})
+	uri := openDocument(t, s, dir, "main.cffc")
+	actions := codeActions(t, s, uri, lspRange(5, 2, 5, 11), lsp.CAKRefactorExtract)
+	if got := applyAction(t, s, uri, findAction(t, actions, "Extract to function")); got != want {
+		t.Errorf("got\n%s\nwant\n%s", got, want)
+	}
+}
+
+func TestExtractFunctionBeforeVoidReturn(t *testing.T) {
+	src := `package main;
+
+func log(n: i32): void {
+	if (n > 0) {
+		print(n);
+	}
+	print(n);
+	return;
+}
+`
+	want := `package main;
+
+func log(n: i32): void {
+	if (n > 0) {
+		print(n);
+	}
+	extracted(n);
+	return;
+}
+
+func extracted(n: i32) {
+	print(n);
+	return;
+}
+`
+	s, dir := newTestServer(t, map[string]string{"main.cffc": src})
+	uri := openDocument(t, s, dir, "main.cffc")
+	actions := codeActions(t, s, uri, lspRange(6, 1, 7, 8), lsp.CAKRefactorExtract)
+	if got := applyAction(t, s, uri, findAction(t, actions, "Extract to function")); got != want {
+		t.Errorf("got\n%s\nwant\n%s", got, want)
+	}
+}
+
+func TestExtractVariable(t *testing.T) {
+	src := `package main;
+
+func main(): void {
+	var a: i32 = 1;
+	print(a * 2);
+	print(a * 2);
+}
+`
+	tests := []struct {
+		title string
+		want  string
+	}{
+		{"Extract to variable", `package main;
+
+func main(): void {
+	var a: i32 = 1;
+	var value: i32 = a * 2;
+	print(value);
+	print(a * 2);
+}
+`},
+		{"Extract to variable (replace all 2 occurrences)", `package main;
+
+func main(): void {
+	var a: i32 = 1;
+	var value: i32 = a * 2;
+	print(value);
+	print(value);
+}
+`},
+	}
+	s, dir := newTestServer(t, map[string]string{"main.cffc": src})
+	uri := openDocument(t, s, dir, "main.cffc")
+	actions := codeActions(t, s, uri, lspRange(4, 7, 4, 12), lsp.CAKRefactorExtract)
+	for _, tt := range tests {
+		if got := applyAction(t, s, uri, findAction(t, actions, tt.title)); got != tt.want {
+			t.Errorf("%s: got\n%s\nwant\n%s", tt.title, got, tt.want)
+		}
+	}
+}
+
+func TestExtractOnStaleAST(t *testing.T) {
+	src := `package main;
+
+func main(): void {
+	var a: i32 = 1;
+	print(a);
+}
+`
+	s, dir := newTestServer(t, map[string]string{"main.cffc": src})
+	uri := openDocument(t, s, dir, "main.cffc")
+	selection := lspRange(4, 1, 4, 10)
+
+	// Broken text after the function leaves the selection untouched, so the
+	// action still applies to the current text.
+	editDocument(s, uri, src+"func (\n")
+	actions := codeActions(t, s, uri, selection, lsp.CAKRefactorExtract)
+	want := `package main;
+
+func main(): void {
+	var a: i32 = 1;
+	extracted(a);
+}
+
+func extracted(a: i32) {
+	print(a);
+}
+func (
+`
+	if got := applyAction(t, s, uri, findAction(t, actions, "Extract to function")); got != want {
+		t.Errorf("got\n%s\nwant\n%s", got, want)
+	}
+
+	// The new function goes after the enclosing one, whose end no longer
+	// reads as it did when parsed, so nothing may be offered.
+	editDocument(s, uri, `package main;
+
+func main(): void {
+	var a: i32 = 1;
+	print(a);
++}
+`)
+	if actions := codeActions(t, s, uri, selection, lsp.CAKRefactorExtract); len(actions) > 0 {
+		t.Errorf("got %d actions on edited text, want none", len(actions))
+	}
+}
+
+func TestInlineFunction(t *testing.T) {
+	src := `package main;
+
+func twice(n: i32): i32 {
+	return n + n;
+}
+
+func main(): void {
+	var x: i32 = twice(2);
+}
+`
+	s, dir := newTestServer(t, map[string]string{"main.cffc": src})
+	uri := openDocument(t, s, dir, "main.cffc")
+	actions := codeActions(t, s, uri, lspRange(7, 16, 7, 16), lsp.CAKRefactorInline)
+
+	want := `package main;
+
+func twice(n: i32): i32 {
+	return n + n;
+}
+
+func main(): void {
+	var x: i32 = (2 + 2);
+}
+`
+	if got := applyAction(t, s, uri, findAction(t, actions, "Inline call to 'twice'")); got != want {
+		t.Errorf("inline call: got\n%s\nwant\n%s", got, want)
+	}
+	want = `package main;
+
+func main(): void {
+	var x: i32 = (2 + 2);
+}
+`
+	if got := applyAction(t, s, uri, findAction(t, actions, "Inline function 'twice'")); got != want {
+		t.Errorf("inline function: got\n%s\nwant\n%s", got, want)
+	}
+}
+
+func TestInlineRefusesCapturedNames(t *testing.T) {
+	src := `package main;
+
+var k: i32 = 10;
+
+func addk(n: i32): i32 {
+	return n + k;
+}
+
+func main(): void {
+	const var c: i32 = k * 2;
+	var a: i32 = addk(1);
+	if (a > 0) {
+		var k: i32 = 5;
+		var b: i32 = addk(2);
+		var d: i32 = c;
+	}
+}
+`
+	s, dir := newTestServer(t, map[string]string{"main.cffc": src})
+	uri := openDocument(t, s, dir, "main.cffc")
+
+	actions := codeActions(t, s, uri, lspRange(10, 15, 10, 15), lsp.CAKRefactorInline)
+	findAction(t, actions, "Inline call to 'addk'")
+
+	tests := []struct {
+		name string
+		rng  lsp.Range
+	}{
+		{"call under a shadowing k", lspRange(13, 16, 13, 16)},
+		{"constant used under a shadowing k", lspRange(9, 12, 9, 12)},
+	}
+	for _, tt := range tests {
+		if actions := codeActions(t, s, uri, tt.rng, lsp.CAKRefactorInline); len(actions) > 0 {
+			t.Errorf("%s: got %q, want no actions", tt.name, actions[0].Title)
+		}
+	}
+}
+
+func TestInlineFunctionKeepsReferencedDeclaration(t *testing.T) {
+	src := `package main;
+
+func value(): i32 {
+	return 3;
+}
+
+func user(): void {
+	var f: i32 = value();
+	var g: i32 = value;
+}
+`
+	s, dir := newTestServer(t, map[string]string{"main.cffc": src})
+	uri := openDocument(t, s, dir, "main.cffc")
+	actions := codeActions(t, s, uri, lspRange(7, 15, 7, 15), lsp.CAKRefactorInline)
+	findAction(t, actions, "Inline call to 'value'")
+	for _, a := range actions {
+		if a.Title == "Inline function 'value'" {
+			t.Errorf("offered to delete 'value' while it is still referenced")
+		}
+	}
+}
+
+func TestInlineOnStaleAST(t *testing.T) {
+	src := `package main;
+
+func twice(n: i32): i32 {
+	return n + n;
+}
+
+func main(): void {
+	var x: i32 = twice(2);
+}
+`
+	s, dir := newTestServer(t, map[string]string{"main.cffc": src})
+	uri := openDocument(t, s, dir, "main.cffc")
+
+	// The body of twice no longer reads as it did when parsed.
+	editDocument(s, uri, `package main;
+
+func twice(n: i32): i32 {
+	return n + n +;
+}
+
+func main(): void {
+	var x: i32 = twice(2);
+}
+`)
+	if actions := codeActions(t, s, uri, lspRange(7, 16, 7, 16), lsp.CAKRefactorInline); len(actions) > 0 {
+		t.Errorf("got %q on edited text, want no actions", actions[0].Title)
+	}
+
+	// A document shorter than the parsed text must not be indexed with the
+	// old offsets.
+	editDocument(s, uri, "package main;\nfunc (\n")
+	if actions := codeActions(t, s, uri, lspRange(1, 2, 1, 2)); len(actions) > 0 {
+		t.Errorf("got %q on truncated text, want no actions", actions[0].Title)
+	}
+}
@@ -0,0 +1,463 @@
+package main
+
+import (
+	"math"
+	"strings"
+
+	"github.com/alecthomas/participle/v2/lexer"
+)
+
+var builtinTypes = []string{"void", "bool", "i1", "i8", "i16", "i32", "i64", "i128", "f16", "f32", "f64", "f128", "string"}
+
+func isBuiltinType(t string) bool {
+	t = strings.TrimLeft(t, "*")
+	for _, b := range builtinTypes {
+		if b == t {
+			return true
+		}
+	}
+	return false
+}
+
+// Binding is a name introduced by a declaration.
+type Binding struct {
+	Name     string
+	Kind     string // variable, parameter, field, function, method, extern or class
+	Type     string // declared type, or the return type for functions
+	Pos      lexer.Position
+	Node     interface{}
+	Scope    *Scope
+	Exported bool
+	Private  bool
+	Static   bool
+	Constant bool
+}
+
+// Scope is a region of a program in which a set of bindings is visible.
+// Start and End are byte offsets into the document.
+type Scope struct {
+	Parent   *Scope
+	Children []*Scope
+	Start    int
+	End      int
+	Bindings []*Binding
+	Class    *ClassDefinition
+	Function *FunctionDefinition
+
+	// File is the module the scope was built from. It is only set on file
+	// scopes of other modules, see Server.scopesOf.
+	File string
+}
+
+// BuildScopes builds the scope tree of a parsed program. The returned file
+// scope covers the whole document.
+func BuildScopes(prog *Program) *Scope {
+	file := &Scope{Start: 0, End: math.MaxInt}
+	file.addStatements(prog.Statements)
+	return file
+}
+
+func (sc *Scope) child(start, end int) *Scope {
+	c := &Scope{Parent: sc, Start: start, End: end, Class: sc.Class, Function: sc.Function}
+	sc.Children = append(sc.Children, c)
+	return c
+}
+
+func (sc *Scope) declare(b *Binding) {
+	b.Scope = sc
+	sc.Bindings = append(sc.Bindings, b)
+}
+
+// braceSpans returns the byte ranges of the outermost { } blocks in tokens,
+// braces included.
+func braceSpans(tokens []lexer.Token) [][2]int {
+	var spans [][2]int
+	depth, start := 0, 0
+	for _, t := range tokens {
+		switch t.Value {
+		case "{":
+			if depth == 0 {
+				start = t.Pos.Offset
+			}
+			depth++
+		case "}":
+			depth--
+			if depth == 0 {
+				spans = append(spans, [2]int{start, t.Pos.Offset + 1})
+			}
+		}
+	}
+	return spans
+}
+
+// tokensEnd returns the offset just past the last token of a node.
+func tokensEnd(tokens []lexer.Token) int {
+	if len(tokens) == 0 {
+		return 0
+	}
+	last := tokens[len(tokens)-1]
+	return last.Pos.Offset + len(last.Value)
+}
+
+func (sc *Scope) addStatements(stmts []*Statement) {
+	for _, stmt := range stmts {
+		if stmt != nil {
+			sc.addStatement(stmt, stmt, false)
+		}
+	}
+}
+
+// addStatement declares what stmt introduces and builds scopes for its
+// blocks. outer is the statement that carries the tokens, which differs from
+// stmt for exported declarations.
+func (sc *Scope) addStatement(outer, stmt *Statement, exported bool) {
+	spans := braceSpans(outer.Tokens)
+	body := func(i int) *Scope {
+		if i < len(spans) {
+			return sc.child(spans[i][0], spans[i][1])
+		}
+		return sc.child(outer.Pos.Offset, tokensEnd(outer.Tokens))
+	}
+
+	switch {
+	case stmt.Export != nil:
+		sc.addStatement(outer, stmt.Export, true)
+	case stmt.VariableDefinition != nil:
+		vd := stmt.VariableDefinition
+		sc.declare(&Binding{Name: vd.Name.Value, Kind: "variable", Type: vd.Type.Value, Pos: stmt.Pos, Node: vd, Exported: exported, Constant: vd.Constant})
+	case stmt.FieldDefinition != nil:
+		fd := stmt.FieldDefinition
+		sc.declare(&Binding{Name: fd.Name.Value, Kind: "field", Type: fd.Type.Value, Pos: stmt.Pos, Node: fd, Private: fd.Private})
+	case stmt.External != nil:
+		ext := stmt.External
+		sc.declare(&Binding{Name: strings.Trim(ext.Name.Value, "\""), Kind: "extern", Type: ext.ReturnType.Value, Pos: stmt.Pos, Node: ext, Exported: exported})
+	case stmt.FunctionDefinition != nil:
+		fd := stmt.FunctionDefinition
+		kind := "function"
+		if sc.Class != nil {
+			kind = "method"
+		}
+		sc.declare(&Binding{Name: funcName(fd), Kind: kind, Type: fd.ReturnType.Value, Pos: stmt.Pos, Node: fd, Exported: exported, Private: fd.Private, Static: fd.Static})
+
+		fn := body(0)
+		fn.Function = fd
+		for _, p := range fd.Parameters {
+			fn.declare(&Binding{Name: p.Name.Value, Kind: "parameter", Type: p.Type.Value, Pos: p.Pos, Node: p})
+		}
+		fn.addStatements(fd.Body)
+	case stmt.ClassDefinition != nil:
+		cd := stmt.ClassDefinition
+		sc.declare(&Binding{Name: cd.Name.Value, Kind: "class", Type: cd.Name.Value, Pos: stmt.Pos, Node: cd, Exported: exported})
+
+		class := body(0)
+		class.Class = cd
+		class.Function = nil
+		class.addStatements(cd.Body)
+	case stmt.If != nil:
+		body(0).addStatements(stmt.If.Body)
+		for i, e := range stmt.If.ElseIf {
+			body(i + 1).addStatements(e.Body)
+		}
+		if stmt.If.Else != nil {
+			body(len(stmt.If.ElseIf) + 1).addStatements(stmt.If.Else)
+		}
+	case stmt.For != nil:
+		// The loop variable is visible in the condition, increment and body.
+		loop := sc.child(outer.Pos.Offset, tokensEnd(outer.Tokens))
+		loop.addStatements([]*Statement{stmt.For.Initializer, stmt.For.Increment})
+		loop.addStatements(stmt.For.Body)
+	case stmt.While != nil:
+		body(0).addStatements(stmt.While.Body)
+	}
+}
+
+// funcName returns the name a function definition is called by: its
+// identifier, or the operator string for `func op "..."` overloads.
+func funcName(fd *FunctionDefinition) string {
+	if fd.Name.Name.Value != "" {
+		return fd.Name.Name.Value
+	}
+	return strings.Trim(fd.Name.String, "\"")
+}
+
+// Innermost returns the deepest scope below sc that contains offset.
+func (sc *Scope) Innermost(offset int) *Scope {
+	for _, c := range sc.Children {
+		if c.Start <= offset && offset < c.End {
+			return c.Innermost(offset)
+		}
+	}
+	return sc
+}
+
+// isLocal reports whether bindings of the scope are only visible after their
+// declaration, which holds for function and block scopes.
+func (sc *Scope) isLocal() bool {
+	return sc.Parent != nil && sc.Function != nil
+}
+
+func (sc *Scope) lookupHere(name string, offset int) *Binding {
+	var found *Binding
+	for _, b := range sc.Bindings {
+		if b.Name != name || (sc.isLocal() && b.Pos.Offset > offset) {
+			continue
+		}
+		found = b
+	}
+	return found
+}
+
+// Lookup resolves name as seen from offset, walking outwards from the
+// innermost scope. Locals only become visible after their declaration while
+// file and class members are visible everywhere.
+func (sc *Scope) Lookup(name string, offset int) *Binding {
+	for s := sc.Innermost(offset); s != nil; s = s.Parent {
+		if b := s.lookupHere(name, offset); b != nil {
+			return b
+		}
+	}
+	return nil
+}
+
+// Visible returns every binding visible from offset, innermost first, with
+// shadowed names left out.
+func (sc *Scope) Visible(offset int) []*Binding {
+	var visible []*Binding
+	seen := make(map[string]bool)
+	for s := sc.Innermost(offset); s != nil; s = s.Parent {
+		for i := len(s.Bindings) - 1; i >= 0; i-- {
+			b := s.Bindings[i]
+			if seen[b.Name] || (s.isLocal() && b.Pos.Offset > offset) {
+				continue
+			}
+			seen[b.Name] = true
+			visible = append(visible, b)
+		}
+	}
+	return visible
+}
+
+func (sc *Scope) root() *Scope {
+	for sc.Parent != nil {
+		sc = sc.Parent
+	}
+	return sc
+}
+
+// ClassScope returns the body scope of the class with the given name, or nil
+// if the program does not declare it.
+func (sc *Scope) ClassScope(name string) *Scope {
+	name = strings.TrimLeft(name, "*")
+	for _, c := range sc.root().Children {
+		if c.Class != nil && c.Class.Name.Value == name {
+			return c
+		}
+	}
+	return nil
+}
+
+// Member returns the field or method of a class scope with the given name.
+func (sc *Scope) Member(name string) *Binding {
+	for _, b := range sc.Bindings {
+		if b.Name == name {
+			return b
+		}
+	}
+	return nil
+}
+
+// EnclosingClass returns the class whose body contains offset.
+func (sc *Scope) EnclosingClass(offset int) *ClassDefinition {
+	return sc.Innermost(offset).Class
+}
+
+// EnclosingFunction returns the function whose body contains offset.
+func (sc *Scope) EnclosingFunction(offset int) *FunctionDefinition {
+	return sc.Innermost(offset).Function
+}
+
+func pointerTo(t string, refs, derefs int) string {
+	for ; derefs > 0 && strings.HasPrefix(t, "*"); derefs-- {
+		t = t[1:]
+	}
+	return strings.Repeat("*", refs) + t
+}
+
+// IdentifierType returns the type of an identifier chain such as
+// `*p.next.value` as seen from offset, or "" if it cannot be resolved.
+func (sc *Scope) IdentifierType(iden *Identifier, offset int) string {
+	var t string
+	if iden.Name == "this" {
+		if class := sc.EnclosingClass(offset); class != nil {
+			t = class.Name.Value
+		}
+	} else if b := sc.Lookup(iden.Name, offset); b != nil {
+		t = b.Type
+	}
+
+	for sub := iden.Sub; sub != nil && t != ""; sub = sub.Sub {
+		class := sc.ClassScope(t)
+		if class == nil {
+			return ""
+		}
+		member := class.Member(sub.Name)
+		if member == nil {
+			return ""
+		}
+		t = pointerTo(member.Type, len(sub.Ref), len(sub.Deref))
+	}
+
+	if t == "" {
+		return ""
+	}
+	return pointerTo(t, len(iden.Ref), len(iden.Deref))
+}
+
+// ExpressionType infers the type of an expression as seen from offset. It
+// returns "" when the type cannot be determined.
+func (sc *Scope) ExpressionType(expr *Expression, offset int) string {
+	if expr == nil {
+		return ""
+	}
+	for _, op := range expr.Right {
+		if op.Op.Value == "&&" || op.Op.Value == "||" {
+			return "bool"
+		}
+	}
+	if len(expr.Left.Right) > 0 {
+		return "bool"
+	}
+	return sc.FactorType(expr.Left.Left.Left, offset)
+}
+
+// FactorType infers the type of a single factor, see ExpressionType.
+func (sc *Scope) FactorType(fact *Factor, offset int) string {
+	switch {
+	case fact.Value != nil:
+		v := fact.Value
+		switch {
+		case v.Float != nil:
+			return "f64"
+		case v.Int != nil, v.HexInt != nil, v.Duration != nil:
+			return "i64"
+		case v.Bool != nil:
+			return "bool"
+		case v.String != nil:
+			return "string"
+		}
+	case fact.FunctionCall != nil:
+		if b := sc.Lookup(strings.Trim(fact.FunctionCall.FunctionName, "\""), offset); b != nil {
+			return b.Type
+		}
+	case fact.BitCast != nil:
+		if fact.BitCast.Type != "" {
+			return fact.BitCast.Type
+		}
+		return sc.ExpressionType(fact.BitCast.Expr, offset)
+	case fact.ClassInitializer != nil:
+		return fact.ClassInitializer.ClassName.Value
+	case fact.ClassMethod != nil:
+		return sc.methodType(fact.ClassMethod.Identifier, offset)
+	case fact.Identifier != nil:
+		return sc.IdentifierType(fact.Identifier, offset)
+	}
+	return ""
+}
+
+// methodType returns the return type of the method called through iden,
+// where the last element of the chain names the method.
+func (sc *Scope) methodType(iden *Identifier, offset int) string {
+	receiver := &Identifier{Ref: iden.Ref, Deref: iden.Deref, Name: iden.Name}
+	last := receiver
+	method := iden.Sub
+	for ; method != nil && method.Sub != nil; method = method.Sub {
+		last.Sub = &Identifier{Ref: method.Ref, Deref: method.Deref, Name: method.Name}
+		last = last.Sub
+	}
+	if method == nil {
+		return ""
+	}
+
+	var class *Scope
+	if b := sc.Lookup(receiver.Name, offset); b != nil && b.Kind == "class" && receiver.Sub == nil {
+		class = sc.ClassScope(b.Name)
+	} else {
+		class = sc.ClassScope(sc.IdentifierType(receiver, offset))
+	}
+	if class == nil {
+		return ""
+	}
+	if m := class.Member(method.Name); m != nil {
+		return m.Type
+	}
+	return ""
+}
+
+// nameToken returns the first token in tokens that spells name.
+func nameToken(tokens []lexer.Token, name string) (lexer.Token, bool) {
+	for _, t := range tokens {
+		if t.Value == name {
+			return t, true
+		}
+	}
+	return lexer.Token{}, false
+}
+
+func tokenContains(t lexer.Token, offset int) bool {
+	return t.Pos.Offset <= offset && offset <= t.Pos.Offset+len(t.Value)
+}
+
+// bindingAt resolves the name under offset, which may be a declaration or a
+// reference. When the name is used by a factor, that factor is returned too.
+func bindingAt(prog *Program, sc *Scope, offset int) (*Binding, *Factor) {
+	var found *Binding
+	var factor *Factor
+
+	forEachFactor(prog.Statements, func(fact *Factor) {
+		var name string
+		switch {
+		case fact.FunctionCall != nil:
+			name = strings.Trim(fact.FunctionCall.FunctionName, "\"")
+		case fact.ClassMethod != nil:
+			name = fact.ClassMethod.Identifier.Name
+		case fact.Identifier != nil:
+			name = fact.Identifier.Name
+		case fact.ClassInitializer != nil:
+			name = fact.ClassInitializer.ClassName.Value
+		default:
+			return
+		}
+		if t, ok := nameToken(fact.Tokens, name); ok && tokenContains(t, offset) {
+			if b := sc.Lookup(name, offset); b != nil {
+				found, factor = b, fact
+			}
+		}
+	})
+	if found != nil {
+		return found, factor
+	}
+
+	forEachStatement(prog.Statements, func(stmt *Statement) {
+		var name string
+		switch {
+		case stmt.VariableDefinition != nil:
+			name = stmt.VariableDefinition.Name.Value
+		case stmt.FunctionDefinition != nil:
+			name = funcName(stmt.FunctionDefinition)
+		case stmt.ClassDefinition != nil:
+			name = stmt.ClassDefinition.Name.Value
+		case stmt.FieldDefinition != nil:
+			name = stmt.FieldDefinition.Name.Value
+		case stmt.External != nil:
+			name = strings.Trim(stmt.External.Name.Value, "\"")
+		case stmt.Assignment != nil:
+			name = stmt.Assignment.Left.Name
+		default:
+			return
+		}
+		if t, ok := nameToken(stmt.Tokens, name); ok && tokenContains(t, offset) {
+			found = sc.Lookup(name, stmt.Pos.Offset)
+		}
+	})
+	return found, nil
+}
@@ -0,0 +1,458 @@
+package main
+
+import (
+	"path/filepath"
+	"sort"
+	"strings"
+	"unicode"
+
+	"github.com/alecthomas/participle/v2/lexer"
+	"github.com/vyPal/go-lsp"
+)
+
+// semanticTokenTypes is the token type legend sent in initialize. Tokens
+// refer to the types by index, see the st* constants.
+var semanticTokenTypes = []string{
+	"namespace",
+	"class",
+	"enum",
+	"interface",
+	"struct",
+	"typeParameter",
+	"type",
+	"parameter",
+	"variable",
+	"property",
+	"enumMember",
+	"decorator",
+	"event",
+	"function",
+	"method",
+	"macro",
+	"label",
+	"comment",
+	"string",
+	"keyword",
+	"number",
+	"regexp",
+	"operator",
+}
+
+var semanticTokenModifiers = []string{
+	"declaration",
+	"definition",
+	"readonly",
+	"static",
+	"deprecated",
+	"abstract",
+	"async",
+	"modification",
+	"documentation",
+	"defaultLibrary",
+	"private",
+}
+
+const (
+	stNamespace uint = iota
+	stClass
+	stEnum
+	stInterface
+	stStruct
+	stTypeParameter
+	stType
+	stParameter
+	stVariable
+	stProperty
+	stEnumMember
+	stDecorator
+	stEvent
+	stFunction
+	stMethod
+	stMacro
+	stLabel
+	stComment
+	stString
+	stKeyword
+	stNumber
+	stRegexp
+	stOperator
+)
+
+// Modifier bits, in the order of semanticTokenModifiers. private is not one
+// of the standard modifiers; clients that do not know it ignore it.
+const (
+	smDeclaration uint = 1 << iota
+	smDefinition
+	smReadonly
+	smStatic
+	smDeprecated
+	smAbstract
+	smAsync
+	smModification
+	smDocumentation
+	smDefaultLibrary
+	smPrivate
+)
+
+var semanticTokensLegend = lsp.SemanticTokensLegend{
+	TokenTypes:     semanticTokenTypes,
+	TokenModifiers: semanticTokenModifiers,
+}
+
+// keywords are the words the grammar matches literally.
+var keywords = map[string]bool{
+	"package": true, "import": true, "from": true, "as": true, "export": true,
+	"var": true, "const": true, "func": true, "class": true, "extern": true,
+	"private": true, "static": true, "vararg": true, "op": true, "get": true, "set": true,
+	"if": true, "else": true, "for": true, "while": true, "return": true,
+	"break": true, "continue": true, "new": true, "this": true,
+	"true": true, "false": true, "null": true,
+}
+
+type semanticToken struct {
+	pos    lexer.Position
+	length int
+	typ    uint
+	mods   uint
+}
+
+func bindingTokenType(kind string) uint {
+	switch kind {
+	case "parameter":
+		return stParameter
+	case "field":
+		return stProperty
+	case "class":
+		return stClass
+	case "function", "extern":
+		return stFunction
+	case "method":
+		return stMethod
+	}
+	return stVariable
+}
+
+// bindingModifiers derives the modifiers of every use of b.
+func bindingModifiers(b *Binding) uint {
+	var mods uint
+	if b.Constant {
+		mods |= smReadonly
+	}
+	if b.Static {
+		mods |= smStatic
+	}
+	if b.Private {
+		mods |= smPrivate
+	}
+	if b.Scope != nil && inPackageCache(b.Scope.root().File) {
+		mods |= smDefaultLibrary
+	}
+	return mods
+}
+
+// inPackageCache reports whether file belongs to an installed library rather
+// than to the workspace.
+func inPackageCache(file string) bool {
+	if file == "" {
+		return false
+	}
+	for _, p := range cache.PkgList {
+		if p.Path != "" && strings.HasPrefix(file, p.Path+string(filepath.Separator)) {
+			return true
+		}
+	}
+	return false
+}
+
+// semanticTokens classifies every token of the document's AST, and the
+// comments the lexer drops, in source order. Names are classified by what
+// they resolve to; whatever the AST does not cover falls back to its
+// lexical class.
+func (s *Server) semanticTokens(uri lsp.DocumentURI) []semanticToken {
+	prog := s.asts[string(uri)]
+	if prog == nil {
+		return nil
+	}
+	docPath := uriToPath(uri)
+	sc := BuildScopes(prog)
+
+	type tokenClass struct{ typ, mods uint }
+	imported := make(map[string]tokenClass)
+	for _, sym := range s.importedSymbols(docPath, prog) {
+		c := tokenClass{bindingTokenType(sym.Type), 0}
+		if inPackageCache(sym.Data["file"]) {
+			c.mods = smDefaultLibrary
+		}
+		imported[sym.Name] = c
+		imported[sym.Data["symbol"]] = c
+	}
+
+	var tokens []semanticToken
+	claimed := make(map[int]bool)
+	add := func(pos lexer.Position, length int, typ, mods uint) {
+		if pos.Line > 0 && length > 0 && !claimed[pos.Offset] {
+			claimed[pos.Offset] = true
+			tokens = append(tokens, semanticToken{pos, length, typ, mods})
+		}
+	}
+	addToken := func(t lexer.Token, typ, mods uint) {
+		add(t.Pos, len(t.Value), typ, mods)
+	}
+	// addTokenAt classifies tokens[i], which a node parsed from broken input
+	// may lack.
+	addTokenAt := func(tokens []lexer.Token, i int, typ, mods uint) {
+		if i >= 0 && i < len(tokens) {
+			addToken(tokens[i], typ, mods)
+		}
+	}
+	addName := func(i *IdentWithPos, typ, mods uint) {
+		add(i.Pos, i.EndPos.Offset-i.Pos.Offset, typ, mods)
+	}
+	// Types are written behind their pointer stars, which stay operators.
+	addType := func(pos lexer.Position, name string) {
+		typ := strings.TrimLeft(name, "*")
+		stars := len(name) - len(typ)
+		pos.Offset += stars
+		pos.Column += stars
+		switch class := s.classScope(docPath, prog, sc, typ); {
+		case isBuiltinType(typ):
+			add(pos, len(typ), stType, smDefaultLibrary)
+		case class != nil && inPackageCache(class.root().File):
+			add(pos, len(typ), stClass, smDefaultLibrary)
+		default:
+			add(pos, len(typ), stClass, 0)
+		}
+	}
+	addTypeName := func(i *IdentWithPos) {
+		if i.Value != "" {
+			addType(i.Pos, i.Value)
+		}
+	}
+	nameClass := func(name string, offset int) (tokenClass, bool) {
+		if b := sc.Lookup(name, offset); b != nil {
+			return tokenClass{bindingTokenType(b.Kind), bindingModifiers(b)}, true
+		}
+		c, ok := imported[name]
+		return c, ok
+	}
+
+	var owners []Node
+	methods := make(map[*Identifier]bool)
+	members := make(map[*Identifier]*Binding)
+	Walk(prog, func(n, parent Node) bool {
+		switch n := n.(type) {
+		case *Program:
+			addTokenAt(n.Tokens, 1, stNamespace, 0)
+		case *Statement:
+			if n.Break != nil || n.Continue != nil {
+				addTokenAt(n.Tokens, 0, stKeyword, 0)
+			}
+		case *Import:
+			addTokenAt(n.Tokens, 0, stNamespace, 0)
+		case *FromImport:
+			addTokenAt(n.Tokens, 1, stNamespace, 0)
+			for _, i := range []int{3, 5} {
+				if i < len(n.Tokens) {
+					if c, ok := imported[n.Tokens[i].Value]; ok {
+						addToken(n.Tokens[i], c.typ, c.mods|smDeclaration)
+					}
+				}
+			}
+		case *FromImportMultiple:
+			addTokenAt(n.Tokens, 1, stNamespace, 0)
+		case *Symbol:
+			for _, i := range []int{0, 2} {
+				if i < len(n.Tokens) {
+					if c, ok := imported[n.Tokens[i].Value]; ok {
+						addToken(n.Tokens[i], c.typ, c.mods|smDeclaration)
+					}
+				}
+			}
+		case *VariableDefinition:
+			mods := smDeclaration
+			if n.Constant {
+				mods |= smReadonly
+			}
+			addName(&n.Name, stVariable, mods)
+			addTypeName(&n.Type)
+		case *FieldDefinition:
+			mods := smDeclaration
+			if n.Private {
+				mods |= smPrivate
+			}
+			addName(&n.Name, stProperty, mods)
+			addTypeName(&n.Type)
+		case *ArgumentDefinition:
+			addName(&n.Name, stParameter, smDeclaration)
+			addTypeName(&n.Type)
+		case *ExternalFunctionDefinition:
+			addName(&n.Name, stFunction, smDeclaration)
+			addTypeName(&n.ReturnType)
+		case *FunctionDefinition:
+			typ, mods := stFunction, smDeclaration|smDefinition
+			if len(owners) > 0 {
+				if _, ok := owners[len(owners)-1].(*ClassDefinition); ok {
+					typ = stMethod
+				}
+			}
+			if n.Static {
+				mods |= smStatic
+			}
+			if n.Private {
+				mods |= smPrivate
+			}
+			addName(&n.Name.Name, typ, mods)
+			addTypeName(&n.ReturnType)
+			owners = append(owners, n)
+		case *ClassDefinition:
+			addName(&n.Name, stClass, smDeclaration|smDefinition)
+			owners = append(owners, n)
+		case *OpExpression:
+			addName(&n.Op, stOperator, 0)
+		case *OpComparison:
+			addName(&n.Op, stOperator, 0)
+		case *OpTerm:
+			addName(&n.Op, stOperator, 0)
+		case *Value:
+			switch {
+			case n.Duration != nil:
+				addTokenAt(n.Tokens, 0, stNumber, 0)
+				addTokenAt(n.Tokens, len(n.Tokens)-1, stType, 0)
+			case n.String != nil:
+				add(n.Pos, n.EndPos.Offset-n.Pos.Offset, stString, 0)
+			case n.Float != nil, n.Int != nil, n.HexInt != nil:
+				add(n.Pos, n.EndPos.Offset-n.Pos.Offset, stNumber, 0)
+			default:
+				add(n.Pos, n.EndPos.Offset-n.Pos.Offset, stKeyword, 0)
+			}
+			return false
+		case *BitCast:
+			if n.Type != "" && len(n.Tokens) > 0 {
+				addType(n.Tokens[len(n.Tokens)-1].Pos, n.Type)
+			}
+		case *ClassInitializer:
+			addTypeName(&n.ClassName)
+		case *FunctionCall:
+			c, _ := nameClass(strings.Trim(n.FunctionName, "\""), n.Pos.Offset)
+			if c.typ != stMethod {
+				c.typ = stFunction
+			}
+			add(n.Pos, len(n.FunctionName), c.typ, c.mods)
+		case *ClassMethod:
+			last := n.Identifier
+			for last.Sub != nil {
+				last = last.Sub
+			}
+			methods[last] = true
+		case *Identifier:
+			// The name follows any & and * prefixes.
+			prefix := len(n.Ref) + len(n.Deref)
+			if prefix >= len(n.Tokens) {
+				break
+			}
+			name := n.Tokens[prefix]
+			if _, sub := parent.(*Identifier); sub {
+				c := tokenClass{stProperty, 0}
+				if methods[n] {
+					c.typ = stMethod
+				}
+				if b := members[n]; b != nil {
+					c = tokenClass{bindingTokenType(b.Kind), bindingModifiers(b)}
+				}
+				addToken(name, c.typ, c.mods)
+				break
+			}
+
+			// Members further down the chain are resolved through the
+			// classes of the segments before them.
+			chain := []string{n.Name}
+			for sub := n.Sub; sub != nil; sub = sub.Sub {
+				if class, _ := s.receiverClass(docPath, prog, sc, n.Pos.Offset, chain); class != nil {
+					members[sub] = class.Member(sub.Name)
+				}
+				chain = append(chain, sub.Name)
+			}
+
+			if n.Name == "this" {
+				addToken(name, stKeyword, 0)
+			} else if c, ok := nameClass(n.Name, n.Pos.Offset); ok {
+				addToken(name, c.typ, c.mods)
+			} else {
+				addToken(name, stVariable, 0)
+			}
+		}
+		return true
+	}, func(n, _ Node) {
+		switch n.(type) {
+		case *FunctionDefinition, *ClassDefinition:
+			owners = owners[:len(owners)-1]
+		}
+	})
+
+	for _, t := range prog.Tokens {
+		switch {
+		case t.Value == "":
+		case keywords[t.Value]:
+			addToken(t, stKeyword, 0)
+		case strings.ContainsRune("\"'`", rune(t.Value[0])):
+			addToken(t, stString, 0)
+		case unicode.IsDigit(rune(t.Value[0])):
+			addToken(t, stNumber, 0)
+		case isIdentToken(t):
+			addToken(t, stVariable, 0)
+		case strings.ContainsAny(t.Value, "+-*/%=<>!&|"):
+			addToken(t, stOperator, 0)
+		}
+	}
+	tokens = append(tokens, commentTokens(s.parsed[string(uri)])...)
+
+	sort.Slice(tokens, func(i, j int) bool { return tokens[i].pos.Offset < tokens[j].pos.Offset })
+	return tokens
+}
+
+// commentTokens finds the comments in src, which the lexer drops.
+func commentTokens(src string) []semanticToken {
+	var tokens []semanticToken
+	line, lineStart := 1, 0
+	add := func(start, end int) {
+		pos := lexer.Position{Offset: start, Line: line, Column: start - lineStart + 1}
+		tokens = append(tokens, semanticToken{pos, end - start, stComment, 0})
+	}
+
+	for i := 0; i < len(src); i++ {
+		switch c := src[i]; {
+		case c == '\n':
+			line, lineStart = line+1, i+1
+		case c == '"' || c == '\'' || c == '`':
+			for i++; i < len(src) && src[i] != c; i++ {
+				switch {
+				case src[i] == '\\' && c != '`':
+					i++
+				case src[i] == '\n':
+					line, lineStart = line+1, i+1
+				}
+			}
+		case strings.HasPrefix(src[i:], "//"):
+			end := strings.IndexByte(src[i:], '\n')
+			if end < 0 {
+				end = len(src) - i
+			}
+			add(i, i+end)
+			i += end - 1
+		case strings.HasPrefix(src[i:], "/*"):
+			end := strings.Index(src[i+2:], "*/")
+			if end < 0 {
+				end = len(src)
+			} else {
+				end += i + 4
+			}
+			add(i, end)
+			for ; i < end-1; i++ {
+				if src[i] == '\n' {
+					line, lineStart = line+1, i+1
+				}
+			}
+		}
+	}
+	return tokens
+}
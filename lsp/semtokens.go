@@ -0,0 +1,154 @@
+package main
+
+import (
+	"context"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/vyPal/go-lsp"
+)
+
+type SemanticTokensRangeParams struct {
+	TextDocument lsp.TextDocumentIdentifier `json:"textDocument"`
+	Range        lsp.Range                  `json:"range"`
+}
+
+type SemanticTokensDeltaParams struct {
+	TextDocument     lsp.TextDocumentIdentifier `json:"textDocument"`
+	PreviousResultID string                     `json:"previousResultId"`
+}
+
+type SemanticTokensDelta struct {
+	ResultID string               `json:"resultId,omitempty"`
+	Edits    []SemanticTokensEdit `json:"edits"`
+}
+
+type SemanticTokensEdit struct {
+	Start       uint   `json:"start"`
+	DeleteCount uint   `json:"deleteCount"`
+	Data        []uint `json:"data,omitempty"`
+}
+
+// lineStarts returns the offset of the first byte of every line in doc.
+func lineStarts(doc string) []int {
+	starts := []int{0}
+	for i := 0; i < len(doc); i++ {
+		if doc[i] == '\n' {
+			starts = append(starts, i+1)
+		}
+	}
+	return starts
+}
+
+// encodeSemanticTokens turns tokens positioned by byte offset in doc into the
+// relative five-integer form of the protocol. Tokens are sorted, a token
+// overlapping the one before it is dropped, tokens spanning several lines are
+// split into one token per line and columns are counted in the negotiated
+// position encoding.
+func encodeSemanticTokens(doc string, tokens []semanticToken) []uint {
+	sort.SliceStable(tokens, func(i, j int) bool { return tokens[i].pos.Offset < tokens[j].pos.Offset })
+	starts := lineStarts(doc)
+
+	data := []uint{}
+	prevLine, prevChar, end := 0, 0, 0
+	emit := func(start, stop int, t semanticToken) {
+		text := strings.TrimRight(doc[start:stop], "\r")
+		if text == "" {
+			return
+		}
+		line := sort.Search(len(starts), func(i int) bool { return starts[i] > start }) - 1
+		char := encodedLen(doc[starts[line]:start])
+		if line != prevLine {
+			prevChar = 0
+		}
+		data = append(data, uint(line-prevLine), uint(char-prevChar), uint(encodedLen(text)), t.typ, t.mods)
+		prevLine, prevChar = line, char
+	}
+
+	for _, t := range tokens {
+		start, stop := t.pos.Offset, t.pos.Offset+t.length
+		if start < end || stop > len(doc) || !utf8.ValidString(doc[start:stop]) {
+			continue
+		}
+		for nl := strings.IndexByte(doc[start:stop], '\n'); nl >= 0; nl = strings.IndexByte(doc[start:stop], '\n') {
+			emit(start, start+nl, t)
+			start += nl + 1
+		}
+		emit(start, stop, t)
+		end = stop
+	}
+	return data
+}
+
+// documentTokens returns the semantic tokens of a document positioned in its
+// current text. Tokens of a stale AST that fall into text edited since the
+// last successful parse are dropped.
+func (s *Server) documentTokens(uri lsp.DocumentURI) []semanticToken {
+	var tokens []semanticToken
+	for _, t := range s.semanticTokens(uri) {
+		if start, _, ok := s.liveSpan(uri, t.pos.Offset, t.pos.Offset+t.length); ok {
+			t.pos.Offset = start
+			tokens = append(tokens, t)
+		}
+	}
+	return tokens
+}
+
+func (s *Server) SemanticTokens(ctx context.Context, params lsp.SemanticTokensParams) (*lsp.SemanticTokens, error) {
+	uri := string(params.TextDocument.URI)
+	s.resultID++
+	result := lsp.SemanticTokens{
+		ResultID: strconv.Itoa(s.resultID),
+		Data:     encodeSemanticTokens(s.documents[uri], s.documentTokens(params.TextDocument.URI)),
+	}
+	s.semantic[uri] = result
+	return &result, nil
+}
+
+func (s *Server) SemanticTokensRange(ctx context.Context, params SemanticTokensRangeParams) (*lsp.SemanticTokens, error) {
+	doc := s.documents[string(params.TextDocument.URI)]
+	start, end := positionToOffset(doc, params.Range.Start), positionToOffset(doc, params.Range.End)
+
+	var tokens []semanticToken
+	for _, t := range s.documentTokens(params.TextDocument.URI) {
+		if t.pos.Offset < end && start < t.pos.Offset+t.length {
+			tokens = append(tokens, t)
+		}
+	}
+	return &lsp.SemanticTokens{Data: encodeSemanticTokens(doc, tokens)}, nil
+}
+
+// SemanticTokensDelta answers with the edits turning the previous result into
+// the current one: a single edit replacing everything between the longest
+// common prefix and suffix. When the previous result is not known any more,
+// the full tokens are returned instead.
+func (s *Server) SemanticTokensDelta(ctx context.Context, params SemanticTokensDeltaParams) (interface{}, error) {
+	uri := string(params.TextDocument.URI)
+	previous, ok := s.semantic[uri]
+	current, err := s.SemanticTokens(ctx, lsp.SemanticTokensParams{TextDocument: params.TextDocument})
+	if err != nil || !ok || previous.ResultID != params.PreviousResultID {
+		return current, err
+	}
+
+	old, data := previous.Data, current.Data
+	prefix := 0
+	for prefix < len(old) && prefix < len(data) && old[prefix] == data[prefix] {
+		prefix++
+	}
+	suffix := 0
+	for suffix < len(old)-prefix && suffix < len(data)-prefix && old[len(old)-1-suffix] == data[len(data)-1-suffix] {
+		suffix++
+	}
+
+	delta := SemanticTokensDelta{ResultID: current.ResultID, Edits: []SemanticTokensEdit{}}
+	if prefix < len(old)-suffix || prefix < len(data)-suffix {
+		delta.Edits = append(delta.Edits, SemanticTokensEdit{
+			Start:       uint(prefix),
+			DeleteCount: uint(len(old) - suffix - prefix),
+			Data:        data[prefix : len(data)-suffix],
+		})
+	}
+	return delta, nil
+}
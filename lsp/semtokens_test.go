@@ -0,0 +1,117 @@
+package main
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	"github.com/alecthomas/participle/v2/lexer"
+	"github.com/vyPal/go-lsp"
+)
+
+// applyDelta replays the edits of a delta on the data of a previous result.
+func applyDelta(data []uint, delta SemanticTokensDelta) []uint {
+	out := append([]uint(nil), data...)
+	for i := len(delta.Edits) - 1; i >= 0; i-- {
+		e := delta.Edits[i]
+		rest := append([]uint(nil), out[e.Start+e.DeleteCount:]...)
+		out = append(append(out[:e.Start], e.Data...), rest...)
+	}
+	return out
+}
+
+func TestSemanticTokensDelta(t *testing.T) {
+	src := `package main;
+
+func main(): void {
+	var a: i32 = 1;
+	print(a);
+}
+`
+	s, dir := newTestServer(t, map[string]string{"main.cffc": src})
+	uri := openDocument(t, s, dir, "main.cffc")
+	doc := lsp.TextDocumentIdentifier{URI: uri}
+	ctx := context.Background()
+
+	first, err := s.SemanticTokens(ctx, lsp.SemanticTokensParams{TextDocument: doc})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	editDocument(s, uri, `package main;
+
+func main(): void {
+	var a: i32 = 1;
+	var b: i32 = a;
+	print(b);
+}
+`)
+	result, err := s.SemanticTokensDelta(ctx, SemanticTokensDeltaParams{TextDocument: doc, PreviousResultID: first.ResultID})
+	if err != nil {
+		t.Fatal(err)
+	}
+	delta, ok := result.(SemanticTokensDelta)
+	if !ok {
+		t.Fatalf("got %T, want a delta", result)
+	}
+	if len(delta.Edits) != 1 {
+		t.Fatalf("got %d edits, want 1", len(delta.Edits))
+	}
+	if delta.ResultID == first.ResultID {
+		t.Errorf("delta kept result id %s", delta.ResultID)
+	}
+
+	full, _ := s.SemanticTokens(ctx, lsp.SemanticTokensParams{TextDocument: doc})
+	if got := applyDelta(first.Data, delta); !reflect.DeepEqual(got, full.Data) {
+		t.Errorf("delta applied gives\n%v\nwant\n%v", got, full.Data)
+	}
+	// The tokens before the new line are kept.
+	if delta.Edits[0].Start == 0 {
+		t.Errorf("delta replaces the tokens from the start")
+	}
+}
+
+func TestSemanticTokensDeltaUnchanged(t *testing.T) {
+	src := "package main;\n\nvar a: i32 = 1;\n"
+	s, dir := newTestServer(t, map[string]string{"main.cffc": src})
+	uri := openDocument(t, s, dir, "main.cffc")
+	doc := lsp.TextDocumentIdentifier{URI: uri}
+	ctx := context.Background()
+
+	first, _ := s.SemanticTokens(ctx, lsp.SemanticTokensParams{TextDocument: doc})
+	result, _ := s.SemanticTokensDelta(ctx, SemanticTokensDeltaParams{TextDocument: doc, PreviousResultID: first.ResultID})
+	if delta, ok := result.(SemanticTokensDelta); !ok || len(delta.Edits) != 0 {
+		t.Errorf("got %+v, want a delta without edits", result)
+	}
+}
+
+func TestSemanticTokensDeltaUnknownResult(t *testing.T) {
+	src := "package main;\n\nvar a: i32 = 1;\n"
+	s, dir := newTestServer(t, map[string]string{"main.cffc": src})
+	uri := openDocument(t, s, dir, "main.cffc")
+	doc := lsp.TextDocumentIdentifier{URI: uri}
+
+	result, _ := s.SemanticTokensDelta(context.Background(), SemanticTokensDeltaParams{TextDocument: doc, PreviousResultID: "stale"})
+	full, ok := result.(*lsp.SemanticTokens)
+	if !ok {
+		t.Fatalf("got %T, want full tokens", result)
+	}
+	if len(full.Data) == 0 {
+		t.Errorf("got no tokens")
+	}
+}
+
+func TestEncodeSemanticTokensColumns(t *testing.T) {
+	useEncoding(t, encodingUTF16)
+	doc := "\"😀\" x\n"
+	token := func(offset, length int) semanticToken {
+		return semanticToken{pos: lexer.Position{Offset: offset, Line: 1}, length: length, typ: stString}
+	}
+	got := encodeSemanticTokens(doc, []semanticToken{token(7, 1), token(0, 6)})
+	// The emoji is a surrogate pair, so the string is four UTF-16 units
+	// long and x starts five units after the start of the string.
+	want := []uint{0, 0, 4, stString, 0, 0, 5, 1, stString, 0}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"unicode"
+
+	"github.com/vyPal/go-lsp"
+)
+
+// SignatureHelp mirrors lsp.SignatureHelp with markdown documentation.
+type SignatureHelp struct {
+	Signatures      []SignatureInformation `json:"signatures"`
+	ActiveSignature int                    `json:"activeSignature"`
+	ActiveParameter int                    `json:"activeParameter"`
+}
+
+type SignatureInformation struct {
+	Label         string                     `json:"label"`
+	Documentation interface{}                `json:"documentation,omitempty"`
+	Parameters    []lsp.ParameterInformation `json:"parameters,omitempty"`
+}
+
+// openCall finds the innermost call whose argument list is open at the end of
+// text. It returns the text in front of the `(` and the number of arguments
+// already completed.
+func openCall(text string) (callee string, argument int, ok bool) {
+	depth, inString := 0, false
+	for i := len(text) - 1; i >= 0; i-- {
+		c := text[i]
+		if c == '"' {
+			inString = !inString
+		}
+		if inString {
+			continue
+		}
+		switch c {
+		case ')', ']':
+			depth++
+		case '[':
+			depth--
+		case '(':
+			if depth == 0 {
+				return strings.TrimRightFunc(text[:i], unicode.IsSpace), argument, true
+			}
+			depth--
+		case ',':
+			if depth == 0 {
+				argument++
+			}
+		case ';', '{', '}':
+			if depth == 0 {
+				return "", 0, false
+			}
+		}
+	}
+	return "", 0, false
+}
+
+// SignatureHelp shows the signature of the function, method or constructor
+// being called at the cursor together with its doc comment.
+func (s *Server) SignatureHelp(ctx context.Context, params lsp.TextDocumentPositionParams) (*SignatureHelp, error) {
+	uri := params.TextDocument.URI
+	doc := s.documents[string(uri)]
+	prog := s.asts[string(uri)]
+	if prog == nil {
+		return nil, nil
+	}
+
+	cursor := positionToOffset(doc, params.Position)
+	callee, argument, ok := openCall(doc[:cursor])
+	if !ok {
+		return nil, nil
+	}
+	chain, ok := receiverChain(callee + ".")
+	if !ok {
+		return nil, nil
+	}
+	before := strings.TrimRightFunc(callee, func(r rune) bool { return isIdentRune(r) || r == '.' })
+	isNew := strings.HasSuffix(strings.TrimRightFunc(before, unicode.IsSpace), "new") && len(chain) == 1
+
+	docPath := uriToPath(uri)
+	offset := s.astOffset(uri, cursor)
+	sc := BuildScopes(prog)
+
+	var b *Binding
+	name := chain[len(chain)-1]
+	switch {
+	case isNew:
+		if class := s.classScope(docPath, prog, sc, name); class != nil {
+			b = class.Member("constructor")
+		}
+	case len(chain) > 1:
+		if class, _ := s.receiverClass(docPath, prog, sc, offset, chain[:len(chain)-1]); class != nil {
+			b = class.Member(name)
+		}
+	default:
+		if b = sc.Lookup(name, offset); b == nil {
+			for _, sym := range s.importedSymbols(docPath, prog) {
+				if sym.Name != name {
+					continue
+				}
+				if imported, err := s.scopesOf(sym.Data["file"]); err == nil {
+					b = imported.Lookup(sym.Data["symbol"], 0)
+				}
+			}
+		}
+	}
+	if b == nil {
+		return nil, nil
+	}
+
+	var parameters []*ArgumentDefinition
+	variadic := false
+	switch node := b.Node.(type) {
+	case *FunctionDefinition:
+		parameters, variadic = node.Parameters, node.Variadic
+	case *ExternalFunctionDefinition:
+		parameters, variadic = node.Parameters, node.Variadic
+	default:
+		return nil, nil
+	}
+
+	label := name + "("
+	info := SignatureInformation{}
+	for i, p := range parameters {
+		if i > 0 {
+			label += ", "
+		}
+		param := p.Name.Value + ": " + p.Type.Value
+		info.Parameters = append(info.Parameters, lsp.ParameterInformation{Label: param})
+		label += param
+	}
+	if variadic {
+		label += ", ..."
+	}
+	label += ")"
+	if b.Type != "" {
+		label += ": " + b.Type
+	}
+	info.Label = label
+	if d := s.bindingDoc(b, docPath); d != "" {
+		info.Documentation = MarkupContent{Kind: "markdown", Value: d}
+	}
+
+	if argument >= len(parameters) && len(parameters) > 0 && !variadic {
+		argument = len(parameters) - 1
+	}
+	return &SignatureHelp{Signatures: []SignatureInformation{info}, ActiveParameter: argument}, nil
+}
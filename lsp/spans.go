@@ -0,0 +1,182 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+
+	"github.com/alecthomas/participle/v2/lexer"
+	"github.com/vyPal/go-lsp"
+)
+
+// Node is implemented by every AST node. The span runs from the first byte
+// of the node's first token to just past its last token.
+type Node interface {
+	Span() (start, end lexer.Position)
+}
+
+func (n *IdentWithPos) Span() (lexer.Position, lexer.Position)               { return n.Pos, n.EndPos }
+func (n *Duration) Span() (lexer.Position, lexer.Position)                   { return n.Pos, n.EndPos }
+func (n *Value) Span() (lexer.Position, lexer.Position)                      { return n.Pos, n.EndPos }
+func (n *Identifier) Span() (lexer.Position, lexer.Position)                 { return n.Pos, n.EndPos }
+func (n *ArgumentList) Span() (lexer.Position, lexer.Position)               { return n.Pos, n.EndPos }
+func (n *ClassInitializer) Span() (lexer.Position, lexer.Position)           { return n.Pos, n.EndPos }
+func (n *FunctionCall) Span() (lexer.Position, lexer.Position)               { return n.Pos, n.EndPos }
+func (n *Factor) Span() (lexer.Position, lexer.Position)                     { return n.Pos, n.EndPos }
+func (n *BitCast) Span() (lexer.Position, lexer.Position)                    { return n.Pos, n.EndPos }
+func (n *Term) Span() (lexer.Position, lexer.Position)                       { return n.Pos, n.EndPos }
+func (n *OpTerm) Span() (lexer.Position, lexer.Position)                     { return n.Pos, n.EndPos }
+func (n *Comparison) Span() (lexer.Position, lexer.Position)                 { return n.Pos, n.EndPos }
+func (n *OpComparison) Span() (lexer.Position, lexer.Position)               { return n.Pos, n.EndPos }
+func (n *Expression) Span() (lexer.Position, lexer.Position)                 { return n.Pos, n.EndPos }
+func (n *OpExpression) Span() (lexer.Position, lexer.Position)               { return n.Pos, n.EndPos }
+func (n *Assignment) Span() (lexer.Position, lexer.Position)                 { return n.Pos, n.EndPos }
+func (n *VariableDefinition) Span() (lexer.Position, lexer.Position)         { return n.Pos, n.EndPos }
+func (n *FieldDefinition) Span() (lexer.Position, lexer.Position)            { return n.Pos, n.EndPos }
+func (n *ArgumentDefinition) Span() (lexer.Position, lexer.Position)         { return n.Pos, n.EndPos }
+func (n *FuncName) Span() (lexer.Position, lexer.Position)                   { return n.Pos, n.EndPos }
+func (n *FunctionDefinition) Span() (lexer.Position, lexer.Position)         { return n.Pos, n.EndPos }
+func (n *ClassDefinition) Span() (lexer.Position, lexer.Position)            { return n.Pos, n.EndPos }
+func (n *ClassMethod) Span() (lexer.Position, lexer.Position)                { return n.Pos, n.EndPos }
+func (n *If) Span() (lexer.Position, lexer.Position)                         { return n.Pos, n.EndPos }
+func (n *ElseIf) Span() (lexer.Position, lexer.Position)                     { return n.Pos, n.EndPos }
+func (n *For) Span() (lexer.Position, lexer.Position)                        { return n.Pos, n.EndPos }
+func (n *While) Span() (lexer.Position, lexer.Position)                      { return n.Pos, n.EndPos }
+func (n *Return) Span() (lexer.Position, lexer.Position)                     { return n.Pos, n.EndPos }
+func (n *ExternalFunctionDefinition) Span() (lexer.Position, lexer.Position) { return n.Pos, n.EndPos }
+func (n *Import) Span() (lexer.Position, lexer.Position)                     { return n.Pos, n.EndPos }
+func (n *FromImport) Span() (lexer.Position, lexer.Position)                 { return n.Pos, n.EndPos }
+func (n *FromImportMultiple) Span() (lexer.Position, lexer.Position)         { return n.Pos, n.EndPos }
+func (n *Symbol) Span() (lexer.Position, lexer.Position)                     { return n.Pos, n.EndPos }
+func (n *Statement) Span() (lexer.Position, lexer.Position)                  { return n.Pos, n.EndPos }
+func (n *Program) Span() (lexer.Position, lexer.Position)                    { return n.Pos, n.EndPos }
+
+// nodeRange returns the LSP range covered by a node in doc, the text it was
+// parsed from.
+func nodeRange(doc string, n Node) lsp.Range {
+	start, end := nodeOffsets(n)
+	return offsetRange(doc, start, end)
+}
+
+// nodeOffsets returns the byte offsets covered by a node.
+func nodeOffsets(n Node) (int, int) {
+	start, end := n.Span()
+	return start.Offset, end.Offset
+}
+
+// tokenEndPos returns the position just past t.
+func tokenEndPos(t lexer.Token) lexer.Position {
+	end := t.Pos
+	end.Offset += len(t.Value)
+	if nl := strings.LastIndexByte(t.Value, '\n'); nl >= 0 {
+		end.Line += strings.Count(t.Value, "\n")
+		end.Column = len(t.Value) - nl
+	} else {
+		end.Column += len(t.Value)
+	}
+	return end
+}
+
+// parseProgram parses src and completes the spans participle leaves out.
+func parseProgram(src string) (*Program, error) {
+	prog, err := parser.Parse("", strings.NewReader(src))
+	if prog != nil {
+		fixSpans(reflect.ValueOf(prog))
+	}
+	return prog, err
+}
+
+var (
+	positionType = reflect.TypeOf(lexer.Position{})
+	tokensType   = reflect.TypeOf([]lexer.Token{})
+)
+
+// fixSpans walks the tree under v. Participle sets EndPos to the start of the
+// next token, so it is moved to the end of the node's own tokens. Captured
+// values such as names and types get no position at all; they are matched
+// against the tokens of the node holding them, in field order.
+func fixSpans(v reflect.Value) {
+	switch v.Kind() {
+	case reflect.Ptr:
+		if !v.IsNil() {
+			fixSpans(v.Elem())
+		}
+	case reflect.Slice:
+		for i := 0; i < v.Len(); i++ {
+			fixSpans(v.Index(i))
+		}
+	case reflect.Struct:
+		field := v.FieldByName("Tokens")
+		if !field.IsValid() || field.Type() != tokensType {
+			return
+		}
+		tokens := field.Interface().([]lexer.Token)
+		if len(tokens) == 0 {
+			return
+		}
+		end := tokenEndPos(tokens[len(tokens)-1])
+		v.FieldByName("EndPos").Set(reflect.ValueOf(end))
+
+		cursor := 0
+		for i := 0; i < v.NumField(); i++ {
+			field := v.Field(i)
+			if field.Type() == positionType || field.Type() == tokensType {
+				continue
+			}
+			switch x := field.Addr().Interface().(type) {
+			case *IdentWithPos:
+				cursor = x.locate(tokens, cursor)
+			case **Duration:
+				if *x != nil {
+					(*x).Pos, (*x).EndPos = tokens[0].Pos, end
+				}
+			default:
+				fixSpans(field)
+				if offset := spanEnd(field); offset > 0 {
+					for cursor < len(tokens) && tokens[cursor].Pos.Offset < offset {
+						cursor++
+					}
+				}
+			}
+		}
+	}
+}
+
+// locate finds the tokens spelling the captured value at or after tokens[from]
+// and returns the index just past them.
+func (i *IdentWithPos) locate(tokens []lexer.Token, from int) int {
+	if i.Value == "" {
+		return from
+	}
+	for start := from; start < len(tokens); start++ {
+		text := ""
+		for end := start; end < len(tokens) && len(text) < len(i.Value); end++ {
+			text += tokens[end].Value
+			if text == i.Value {
+				i.Pos, i.EndPos = tokens[start].Pos, tokenEndPos(tokens[end])
+				return end + 1
+			}
+		}
+	}
+	return from
+}
+
+// spanEnd returns the end offset of the last node held by a field, or 0.
+func spanEnd(v reflect.Value) int {
+	switch v.Kind() {
+	case reflect.Ptr:
+		if !v.IsNil() {
+			return spanEnd(v.Elem())
+		}
+	case reflect.Slice:
+		for i := v.Len() - 1; i >= 0; i-- {
+			if end := spanEnd(v.Index(i)); end > 0 {
+				return end
+			}
+		}
+	case reflect.Struct:
+		if end := v.FieldByName("EndPos"); end.IsValid() && end.Type() == positionType {
+			return end.Interface().(lexer.Position).Offset
+		}
+	}
+	return 0
+}
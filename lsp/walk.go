@@ -0,0 +1,184 @@
+package main
+
+// Children returns the nodes directly below n in source order. Optional parts
+// that were not written, such as a missing return type, are left out.
+func Children(n Node) []Node {
+	var children []Node
+	add := func(n Node, present bool) {
+		if present {
+			children = append(children, n)
+		}
+	}
+	name := func(i *IdentWithPos) {
+		add(i, i.Value != "")
+	}
+	statements := func(stmts []*Statement) {
+		for _, stmt := range stmts {
+			add(stmt, stmt != nil)
+		}
+	}
+	arguments := func(args []*ArgumentDefinition) {
+		for _, a := range args {
+			add(a, a != nil)
+		}
+	}
+
+	switch n := n.(type) {
+	case *Program:
+		statements(n.Statements)
+	case *Statement:
+		add(n.VariableDefinition, n.VariableDefinition != nil)
+		add(n.Assignment, n.Assignment != nil)
+		add(n.External, n.External != nil)
+		add(n.Export, n.Export != nil)
+		add(n.FunctionDefinition, n.FunctionDefinition != nil)
+		add(n.ClassDefinition, n.ClassDefinition != nil)
+		add(n.If, n.If != nil)
+		add(n.For, n.For != nil)
+		add(n.While, n.While != nil)
+		add(n.Return, n.Return != nil)
+		add(n.FieldDefinition, n.FieldDefinition != nil)
+		add(n.Import, n.Import != nil)
+		add(n.FromImportMultiple, n.FromImportMultiple != nil)
+		add(n.FromImport, n.FromImport != nil)
+		add(n.Expression, n.Expression != nil)
+	case *VariableDefinition:
+		name(&n.Name)
+		name(&n.Type)
+		add(n.Assignment, n.Assignment != nil)
+	case *Assignment:
+		add(n.Left, n.Left != nil)
+		add(n.Right, n.Right != nil)
+	case *ExternalFunctionDefinition:
+		name(&n.Name)
+		arguments(n.Parameters)
+		name(&n.ReturnType)
+	case *FunctionDefinition:
+		add(&n.Name, true)
+		arguments(n.Parameters)
+		name(&n.ReturnType)
+		statements(n.Body)
+	case *FuncName:
+		name(&n.Name)
+	case *ArgumentDefinition:
+		name(&n.Name)
+		name(&n.Type)
+	case *ClassDefinition:
+		name(&n.Name)
+		statements(n.Body)
+	case *FieldDefinition:
+		name(&n.Name)
+		name(&n.Type)
+	case *If:
+		add(n.Condition, n.Condition != nil)
+		statements(n.Body)
+		for _, e := range n.ElseIf {
+			add(e, e != nil)
+		}
+		statements(n.Else)
+	case *ElseIf:
+		add(n.Condition, n.Condition != nil)
+		statements(n.Body)
+	case *For:
+		add(n.Initializer, n.Initializer != nil)
+		add(n.Condition, n.Condition != nil)
+		add(n.Increment, n.Increment != nil)
+		statements(n.Body)
+	case *While:
+		add(n.Condition, n.Condition != nil)
+		statements(n.Body)
+	case *Return:
+		add(n.Expression, n.Expression != nil)
+	case *FromImportMultiple:
+		for i := range n.Symbols {
+			add(&n.Symbols[i], true)
+		}
+	case *Expression:
+		add(n.Left, n.Left != nil)
+		for _, op := range n.Right {
+			add(op, op != nil)
+		}
+	case *OpExpression:
+		name(&n.Op)
+		add(n.Expression, n.Expression != nil)
+	case *Comparison:
+		add(n.Left, n.Left != nil)
+		for _, op := range n.Right {
+			add(op, op != nil)
+		}
+	case *OpComparison:
+		name(&n.Op)
+		add(n.Comparison, n.Comparison != nil)
+	case *Term:
+		add(n.Left, n.Left != nil)
+		for _, op := range n.Right {
+			add(op, op != nil)
+		}
+	case *OpTerm:
+		name(&n.Op)
+		add(n.Term, n.Term != nil)
+	case *Factor:
+		add(n.Value, n.Value != nil)
+		add(n.FunctionCall, n.FunctionCall != nil)
+		add(n.BitCast, n.BitCast != nil)
+		add(n.ClassInitializer, n.ClassInitializer != nil)
+		add(n.ClassMethod, n.ClassMethod != nil)
+		add(n.Identifier, n.Identifier != nil)
+	case *Value:
+		add(n.Duration, n.Duration != nil)
+	case *FunctionCall:
+		add(&n.Args, true)
+	case *BitCast:
+		add(n.Expr, n.Expr != nil)
+	case *ClassInitializer:
+		name(&n.ClassName)
+		add(&n.Args, true)
+	case *ClassMethod:
+		add(n.Identifier, n.Identifier != nil)
+		add(n.Args, n.Args != nil)
+	case *ArgumentList:
+		for _, e := range n.Arguments {
+			add(e, e != nil)
+		}
+	case *Identifier:
+		add(n.GEP, n.GEP != nil)
+		add(n.Sub, n.Sub != nil)
+	}
+	return children
+}
+
+// Walk traverses the tree below n depth first. pre is called for every node
+// before its children and returns whether to descend into them; post, when
+// not nil, is called once they have been visited. Both hooks receive the
+// node's parent, which is nil for n itself.
+func Walk(n Node, pre func(n, parent Node) bool, post func(n, parent Node)) {
+	walk(n, nil, pre, post)
+}
+
+func walk(n, parent Node, pre func(n, parent Node) bool, post func(n, parent Node)) {
+	if !pre(n, parent) {
+		return
+	}
+	for _, child := range Children(n) {
+		walk(child, n, pre, post)
+	}
+	if post != nil {
+		post(n, parent)
+	}
+}
+
+// Inspect calls fn for every node below n in source order, including n. It
+// skips the children of nodes for which fn returns false.
+func Inspect(n Node, fn func(Node) bool) {
+	Walk(n, func(n, _ Node) bool { return fn(n) }, nil)
+}
+
+// Parents maps every node below root to its parent.
+func Parents(root Node) map[Node]Node {
+	parents := make(map[Node]Node)
+	Walk(root, func(n, parent Node) bool {
+		parents[n] = parent
+		return true
+	}, nil)
+	return parents
+}
@@ -116,10 +116,13 @@ export async function registerLSP(context: vscode.ExtensionContext, outputChanne
 
   // Options for the language client
   let clientOptions: LanguageClientOptions = {
-    documentSelector: [{ scheme: 'file', language: 'cffc' }],
+    documentSelector: [
+      { scheme: 'file', language: 'cffc' },
+      { scheme: 'file', pattern: '**/cfconf.yaml' }
+    ],
     synchronize: {
       configurationSection: 'cffc',
-      fileEvents: vscode.workspace.createFileSystemWatcher('**/.cffc')
+      fileEvents: vscode.workspace.createFileSystemWatcher('**/*.cffc')
     }
   };
 